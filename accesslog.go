@@ -0,0 +1,72 @@
+package minicache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// WithCombinedLog writes a line in the Combined Log Format for every request
+// to w, followed by the time taken to serve it in microseconds and, if
+// writing the response failed, the quoted write error.
+func WithCombinedLog(w io.Writer) OptionFunc {
+	return func(c *cache) error {
+		if w == nil {
+			return errors.New("combined log writer must not be nil")
+		}
+		c.accessLog = &accessLog{w: w}
+		return nil
+	}
+}
+
+func (c *cache) logAccess(r *http.Request, w *responseWriter, start time.Time) {
+	end := c.now()
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user := "-"
+	if name, _, ok := r.BasicAuth(); ok && name != "" {
+		user = strconv.Quote(name)
+		user = user[1 : len(user)-1]
+	}
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	size := "-"
+	if w.written > 0 {
+		size = strconv.FormatInt(w.written, 10)
+	}
+	referer, userAgent := "-", "-"
+	if v := r.Referer(); v != "" {
+		referer = v
+	}
+	if v := r.UserAgent(); v != "" {
+		userAgent = v
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s %s %s %d",
+		host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+uri+" "+r.Proto), status, size,
+		strconv.Quote(referer), strconv.Quote(userAgent), end.Sub(start).Microseconds())
+	if w.err != nil {
+		line += " " + strconv.Quote(w.err.Error())
+	}
+	c.accessLog.mu.Lock()
+	defer c.accessLog.mu.Unlock()
+	io.WriteString(c.accessLog.w, line+"\n")
+}
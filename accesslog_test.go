@@ -0,0 +1,66 @@
+package minicache
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCombinedLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		header []string
+		want   string
+	}{
+		{
+			"with headers", "/a?q=1", []string{"Referer", "http://example.com/", "User-Agent", "curl/8.0", "Authorization", "Basic dXNlcjpwYXNz"},
+			`192.0.2.1 - user [02/Jan/2030:03:04:05 +0100] "GET /a?q=1 HTTP/1.1" 200 1 "http://example.com/" "curl/8.0" 1500`,
+		},
+		{
+			"no headers", "/a", nil,
+			`192.0.2.1 - - [02/Jan/2030:03:04:05 +0100] "GET /a HTTP/1.1" 200 1 "-" "-" 1500`,
+		},
+		{
+			"empty body", "/empty", nil,
+			`192.0.2.1 - - [02/Jan/2030:03:04:05 +0100] "GET /empty HTTP/1.1" 204 - "-" "-" 1500`,
+		},
+		{
+			"not found", "/missing", nil,
+			`192.0.2.1 - - [02/Jan/2030:03:04:05 +0100] "GET /missing HTTP/1.1" 404 %d "-" "-" 1500`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offset atomic.Int64
+			start := time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+			var log bytes.Buffer
+			c := New(WithCombinedLog(&log), WithClock(func() time.Time {
+				// Every reading of the clock after the first moves it on,
+				// so the request takes a fixed time however often it looks.
+				return start.Add(time.Duration(offset.Swap(int64(1500 * time.Microsecond))))
+			}))
+			if err := c.Register("/a", constant("a")); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.RegisterStatus("/empty", http.StatusNoContent); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, tt.path, tt.header...)
+			want := tt.want
+			if strings.Contains(want, "%d") {
+				want = fmt.Sprintf(want, w.Body.Len())
+			}
+			if got := log.String(); got != want+"\n" {
+				t.Errorf("logged\n%q, want\n%q", got, want+"\n")
+			}
+		})
+	}
+	if err := WithCombinedLog(nil)(&cache{}); err == nil {
+		t.Error("WithCombinedLog(nil) succeeded")
+	}
+}
@@ -1,43 +1,203 @@
 package minicache
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
+	"golang.org/x/text/unicode/norm"
 )
 
 type cacheRules struct {
-	ttl time.Duration
+	ttl              time.Duration
+	syncRevalidation bool
 }
 
 type HandlerFunc func(path []string) ([]byte, error)
 
+type ContextHandlerFunc func(ctx context.Context, path []string) ([]byte, error)
+
+type RenewalHandlerFunc func(ctx context.Context, path []string, prev []byte, prevExpiry time.Time) ([]byte, error)
+
 type route struct {
-	handler        HandlerFunc
-	staticChildren map[string]*route
-	dynamicChild   *route
-	cacheRules     cacheRules
+	handler            ResponseHandlerFunc
+	pattern            string
+	staticChildren     map[string]*route
+	dynamicChildren    []*route
+	params             []string
+	coldFallback       []byte
+	variants           []variant
+	varyCookie         string
+	constraint         *regexp.Regexp
+	segment            string
+	cacheRules         cacheRules
+	acceptVariants     []string
+	keyFunc            func(r *http.Request, path []string) string
+	keySegments        []int
+	head               *route
+	headHandler        ResponseHandlerFunc
+	headOptions        []RouteOptionFunc
+	bodyInKey          bool
+	maxRequestBody     int64
+	meta               map[string]string
+	auth               func(r *http.Request) bool
+	authChallenge      string
+	sse                SSEHandlerFunc
+	contentDisposition func(path []string) string
+	transforms         []func(body []byte) ([]byte, error)
+	partition          string
+	cardinality        *partition
+	deprecated         bool
+	deprecation        string
+	sunset             time.Time
 }
 
 type cacheEntry struct {
-	value  []byte
-	expiry time.Time
+	entryData
+	// ready is closed once the initial fill has finished, and err holds
+	// its error, if any.
+	ready    chan struct{}
+	err      error
+	renewing atomic.Bool
+	// renewed is closed when the latest background renewal has finished.
+	renewed   chan struct{}
+	partition *partition
 	sync.RWMutex
 }
 
+func newCacheEntry() *cacheEntry {
+	return &cacheEntry{ready: make(chan struct{})}
+}
+
 type cache struct {
-	root       *route
-	cache      map[string]*cacheEntry
-	cacheRules cacheRules
+	// routesMu guards the route tree, which registration may change while
+	// requests are served.
+	routesMu             sync.RWMutex
+	root                 *route
+	cache                map[string]*cacheEntry
+	tags                 map[string]map[string]struct{}
+	keyTags              map[string][]string
+	varies               map[string]*variation
+	variedFrom           map[string]string
+	cacheRules           cacheRules
+	contentType          string
+	newHash              func() hash.Hash
+	now                  func() time.Time
+	requestIDHeader      string
+	foldDynamicCase      bool
+	rootRedirect         string
+	unicodeForm          *norm.Form
+	h2c                  bool
+	maxRecursionDepth    int
+	maxConnections       int
+	maxStreamRate        int
+	maxStreamedBody      int64
+	expvarName           string
+	variantClientID      func(r *http.Request) string
+	clientCacheControl   string
+	debugPath            string
+	store                Store
+	proxyClient          *http.Client
+	serveStaleFromStore  bool
+	surrogateKeyHeader   string
+	fillWaitTimeout      time.Duration
+	dependency           *dependencyCheck
+	strictSlashes        bool
+	renewals             chan struct{}
+	slowHandlerThreshold time.Duration
+	writeTimeout         time.Duration
+	idleTimeout          time.Duration
+	disableKeepAlives    bool
+	rewrite              func(r *http.Request)
+	maxRoutes            int
+	accessLog            *accessLog
+	debugBypassHeader    string
+	varyHost             bool
+	bindAttempts         int
+	bindBackoff          time.Duration
+	onEvict              func(key string, value []byte, reason EvictReason)
+	minTTL               time.Duration
+	maxTTL               time.Duration
+	maxStaleAge          time.Duration
+	synchronous          bool
+	softPurge            bool
+	overloadHandler      func(w http.ResponseWriter, r *http.Request)
+	badRequestHandler    func(w http.ResponseWriter, r *http.Request, err error)
+	trustedHeaders       bool
+	serveOnError         bool
+	serializer           SerializerFunc
+	ttlFunc              func(path []string, resp *Response) time.Duration
+	maxEntries           int
+	evictionPolicy       EvictionPolicy
+	defaultPartition     *partition
+	partitions           map[string]*partition
+	pinned               map[string]bool
+	metrics              MetricsHook
+	inFlightRenewals     map[string]int
+	renewalsMu           sync.Mutex
+	policy               CachePolicyFunc
+	counters             counters
+	// ctx is canceled by Close, which then waits for the background
+	// goroutines tracked by bg.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	bg        sync.WaitGroup
+	bgMu      sync.Mutex
+	closeOnce sync.Once
+	// inflight counts ServeHTTP calls for Shutdown to drain, closing
+	// drained once it drops to zero, and srv is the server started by
+	// Serve, if any.
+	inflight   int
+	drained    chan struct{}
+	inflightMu sync.Mutex
+	srvMu      sync.Mutex
+	srv        *http.Server
 	l          logr.Logger
 	sync.RWMutex
 }
 
+// ErrNotFound may be returned by a handler to report that the requested
+// resource does not exist. A handler returning a nil value without an error
+// is treated the same way. Such results are answered with 404 and never
+// cached, while an empty non-nil value is cached and served as is.
+var ErrNotFound = errors.New("not found")
+
+// ErrNoContent may be returned by a handler for a response with status 204
+// and no body, which is cached like any other.
+var ErrNoContent = errors.New("no content")
+
+// ErrLoopDetected is returned when a request re-enters the cache deeper than
+// allowed, or when a handler requests the key it is itself populating.
+var ErrLoopDetected = errors.New("request loop detected")
+
+// ErrFillTimeout is returned when a request gave up waiting for a cold fill,
+// which carries on in the background for later requests.
+var ErrFillTimeout = errors.New("timed out waiting for the cache to be populated")
+
+// ErrInvalidPath, ErrConflictingRoute and ErrBadEncoding are wrapped by the
+// errors returned for paths that cannot be registered or served.
+var (
+	ErrInvalidPath      = errors.New("invalid path")
+	ErrConflictingRoute = errors.New("conflicting route")
+	ErrBadEncoding      = errors.New("bad path encoding")
+)
+
 type OptionFunc func(c *cache) error
 
 func WithDefaultTTL(ttl time.Duration) OptionFunc {
@@ -47,191 +207,2152 @@ func WithDefaultTTL(ttl time.Duration) OptionFunc {
 	}
 }
 
-func WithLogger(l logr.Logger) OptionFunc {
+// WithMinTTL and WithMaxTTL clamp the TTL of every entry, whether it comes
+// from WithDefaultTTL, the handler's response or Set. New panics if the
+// minimum exceeds the maximum.
+func WithMinTTL(d time.Duration) OptionFunc {
 	return func(c *cache) error {
-		c.l = l
+		if d <= 0 {
+			return errors.New("minimum TTL must be positive")
+		}
+		c.minTTL = d
 		return nil
 	}
 }
 
-func New(options ...OptionFunc) *cache {
-	c := &cache{}
-	for _, o := range options {
-		if err := o(c); err != nil {
-			panic(err)
+func WithMaxTTL(d time.Duration) OptionFunc {
+	return func(c *cache) error {
+		if d <= 0 {
+			return errors.New("maximum TTL must be positive")
 		}
+		c.maxTTL = d
+		return nil
 	}
-	c.root = newRoute()
-	c.root.cacheRules = c.cacheRules
-	c.cache = make(map[string]*cacheEntry)
-	return c
 }
 
-func newRoute() *route {
-	r := &route{}
-	r.staticChildren = make(map[string]*route)
-	return r
+// WithTTLFunc computes the TTL of every entry from the handler's response,
+// for example to keep large or expensive responses longer. f returning zero
+// or less falls back to the TTL of the route.
+func WithTTLFunc(f func(path []string, resp *Response) time.Duration) OptionFunc {
+	return func(c *cache) error {
+		c.ttlFunc = f
+		return nil
+	}
 }
 
-func (r *route) getOrCreateChild(segment string) *route {
-	if segment == "" {
-		return r
+func (c *cache) ttl(r *route, path []string, resp *Response) time.Duration {
+	if resp != nil && resp.TTL > 0 {
+		return resp.TTL
 	}
-	if segment == "*" {
-		if r.dynamicChild == nil {
-			r.dynamicChild = newRoute()
-			r.dynamicChild.cacheRules = r.cacheRules
+	if c.ttlFunc != nil {
+		if ttl := c.ttlFunc(path, resp); ttl > 0 {
+			return ttl
 		}
-		return r.dynamicChild
 	}
-	if _, ok := r.staticChildren[segment]; !ok {
-		r.staticChildren[segment] = newRoute()
-		r.staticChildren[segment].cacheRules = r.cacheRules
+	return r.cacheRules.ttl
+}
+
+// WithMaxStaleAge stops entries from being served once they have been
+// expired for longer than d. They are renewed synchronously instead, and
+// the request fails if that fails.
+func WithMaxStaleAge(d time.Duration) OptionFunc {
+	return func(c *cache) error {
+		if d <= 0 {
+			return errors.New("maximum stale age must be positive")
+		}
+		c.maxStaleAge = d
+		return nil
 	}
-	return r.staticChildren[segment]
 }
 
-func (c *cache) Register(path string, handler HandlerFunc) error {
-	segments, err := fromPath(path)
-	if err != nil {
-		return err
+// WithoutBackgroundRenewal makes requests renew stale entries themselves,
+// waiting for the handler, rather than in the background. A failed renewal
+// still serves the stale entry, short of WithMaxStaleAge. Cold fills also
+// always run in the request, so neither the timeout set by
+// WithFillWaitTimeout nor cold fallbacks apply.
+func WithoutBackgroundRenewal() OptionFunc {
+	return func(c *cache) error {
+		c.synchronous = true
+		return nil
 	}
-	r := c.root
-	for _, p := range segments {
-		r = r.getOrCreateChild(p)
+}
+
+func (c *cache) clampTTL(ttl time.Duration) time.Duration {
+	if c.minTTL > 0 && ttl < c.minTTL {
+		ttl = c.minTTL
 	}
-	r.handler = handler
-	return nil
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
 }
 
-func (c *cache) RegisterOrDie(path string, handler HandlerFunc) {
-	if err := c.Register(path, handler); err != nil {
-		panic(err)
+func WithDefaultContentType(contentType string) OptionFunc {
+	return func(c *cache) error {
+		if contentType == "" {
+			return errors.New("default content type must not be empty")
+		}
+		c.contentType = contentType
+		return nil
 	}
 }
 
-func (c *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path, err := fromPath(r.URL.EscapedPath())
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Header().Add("Content-Type", "text/plain")
-		_, err = w.Write([]byte(err.Error()))
-		if err != nil {
-			c.l.Error(err, "error writing response")
+func WithClock(now func() time.Time) OptionFunc {
+	return func(c *cache) error {
+		if now == nil {
+			return errors.New("clock must not be nil")
+		}
+		c.now = now
+		return nil
+	}
+}
+
+func WithRequestID(header string) OptionFunc {
+	return func(c *cache) error {
+		if header == "" {
+			return errors.New("request ID header must not be empty")
+		}
+		c.requestIDHeader = http.CanonicalHeaderKey(header)
+		return nil
+	}
+}
+
+// WithUnicodeNormalization normalizes the segments of registered patterns
+// and request paths to form, such as norm.NFC, so that paths written in
+// different normal forms share a route and an entry.
+func WithUnicodeNormalization(form norm.Form) OptionFunc {
+	return func(c *cache) error {
+		c.unicodeForm = &form
+		return nil
+	}
+}
+
+// WithRootRedirect redirects requests for "/" to path, such as the
+// documentation of an API, in place of any handler registered for "/".
+func WithRootRedirect(path string) OptionFunc {
+	return func(c *cache) error {
+		if path == "" || path == "/" {
+			return errors.New("root redirect must name a path other than /")
+		}
+		c.rootRedirect = path
+		return nil
+	}
+}
+
+func WithFoldDynamicCase() OptionFunc {
+	return func(c *cache) error {
+		c.foldDynamicCase = true
+		return nil
+	}
+}
+
+// WithVaryHost keeps separate entries per Host header, for a cache serving
+// several virtual hosts.
+func WithVaryHost() OptionFunc {
+	return func(c *cache) error {
+		c.varyHost = true
+		return nil
+	}
+}
+
+func WithH2C(enabled bool) OptionFunc {
+	return func(c *cache) error {
+		c.h2c = enabled
+		return nil
+	}
+}
+
+func WithHashFunc(newHash func() hash.Hash) OptionFunc {
+	return func(c *cache) error {
+		if newHash == nil {
+			return errors.New("hash func must not be nil")
+		}
+		c.newHash = newHash
+		return nil
+	}
+}
+
+func WithMaxRecursionDepth(n int) OptionFunc {
+	return func(c *cache) error {
+		if n < 1 {
+			return errors.New("maximum recursion depth must be positive")
+		}
+		c.maxRecursionDepth = n
+		return nil
+	}
+}
+
+// WithFillWaitTimeout bounds how long a request waits for an entry to be
+// populated. Requests that wait longer are answered with 503, or the cold
+// fallback of the route, while the handler keeps running.
+func WithFillWaitTimeout(d time.Duration) OptionFunc {
+	return func(c *cache) error {
+		if d <= 0 {
+			return errors.New("fill wait timeout must be positive")
+		}
+		c.fillWaitTimeout = d
+		return nil
+	}
+}
+
+// WithStrictSlashes rejects request paths with empty segments, such as
+// /a//b, instead of collapsing them.
+func WithStrictSlashes() OptionFunc {
+	return func(c *cache) error {
+		c.strictSlashes = true
+		return nil
+	}
+}
+
+// WithMaxRenewalGoroutines caps the number of background renewals running at
+// once. Stale entries that find no free slot keep being served as they are.
+func WithMaxRenewalGoroutines(n int) OptionFunc {
+	return func(c *cache) error {
+		if n < 1 {
+			return errors.New("maximum renewal goroutines must be positive")
+		}
+		c.renewals = make(chan struct{}, n)
+		return nil
+	}
+}
+
+// WithSlowHandlerThreshold logs every fill or renewal whose handler takes
+// longer than d.
+func WithSlowHandlerThreshold(d time.Duration) OptionFunc {
+	return func(c *cache) error {
+		if d <= 0 {
+			return errors.New("slow handler threshold must be positive")
+		}
+		c.slowHandlerThreshold = d
+		return nil
+	}
+}
+
+// WithWriteTimeout sets the write timeout of the server started by Serve and
+// makes it the deadline of the context passed to handlers filling the cache
+// for a request.
+func WithWriteTimeout(d time.Duration) OptionFunc {
+	return func(c *cache) error {
+		if d <= 0 {
+			return errors.New("write timeout must be positive")
+		}
+		c.writeTimeout = d
+		return nil
+	}
+}
+
+// WithMaxRoutes makes registering a new route fail once n routes have a
+// handler. Unregistering a route makes room for another.
+func WithMaxRoutes(n int) OptionFunc {
+	return func(c *cache) error {
+		if n < 1 {
+			return errors.New("maximum routes must be positive")
+		}
+		c.maxRoutes = n
+		return nil
+	}
+}
+
+// WithRewrite lets rewrite modify every request, such as its URL path,
+// before it is routed, so the rewritten path is also what is cached. It is
+// given a copy of the request.
+func WithRewrite(rewrite func(r *http.Request)) OptionFunc {
+	return func(c *cache) error {
+		if rewrite == nil {
+			return errors.New("rewrite func must not be nil")
+		}
+		c.rewrite = rewrite
+		return nil
+	}
+}
+
+// WithKeepAlivesEnabled controls whether the server started by Serve keeps
+// connections open between requests. They are enabled by default.
+func WithKeepAlivesEnabled(enabled bool) OptionFunc {
+	return func(c *cache) error {
+		c.disableKeepAlives = !enabled
+		return nil
+	}
+}
+
+// WithIdleTimeout sets how long the server started by Serve keeps an idle
+// connection open waiting for the next request.
+func WithIdleTimeout(d time.Duration) OptionFunc {
+	return func(c *cache) error {
+		if d <= 0 {
+			return errors.New("idle timeout must be positive")
+		}
+		c.idleTimeout = d
+		return nil
+	}
+}
+
+// WithOverloadHandler lets h answer requests the cache turns away because it
+// is overloaded, in place of a plain 503.
+func WithOverloadHandler(h func(w http.ResponseWriter, r *http.Request)) OptionFunc {
+	return func(c *cache) error {
+		if h == nil {
+			return errors.New("overload handler must not be nil")
 		}
+		c.overloadHandler = h
+		return nil
+	}
+}
+
+func (c *cache) overloaded(w http.ResponseWriter, r *http.Request, err error) {
+	if c.overloadHandler != nil {
+		c.overloadHandler(w, r)
 		return
 	}
-	route := c.lookup(path)
-	b, err := c.request(route, path)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Header().Add("Content-Type", "text/plain")
-		_, err = w.Write([]byte(err.Error()))
-		if err != nil {
-			c.l.Error(err, "error writing response")
+	w.Header().Add("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(err.Error()))
+}
+
+// syncHeader is the request header that, with trusted headers enabled,
+// makes the request renew a stale entry synchronously.
+const syncHeader = "X-Minicache-Sync"
+
+// WithTrustedHeaders lets requests control the cache through headers such
+// as X-Minicache-Sync. Only enable it when clients are trusted.
+func WithTrustedHeaders(enabled bool) OptionFunc {
+	return func(c *cache) error {
+		c.trustedHeaders = enabled
+		return nil
+	}
+}
+
+// WithDebugBypassHeader makes requests carrying a non-empty header name be
+// answered by the handler directly, leaving the cache untouched, so the
+// current output of a handler can be seen without affecting other clients.
+// It only takes effect with WithTrustedHeaders.
+func WithDebugBypassHeader(name string) OptionFunc {
+	return func(c *cache) error {
+		if name == "" {
+			return errors.New("debug bypass header name must not be empty")
+		}
+		c.debugBypassHeader = name
+		return nil
+	}
+}
+
+// WithServeOnError serves the value a handler returns along with an error,
+// such as partial data, instead of answering 500. The error is logged and
+// the value is not cached.
+func WithServeOnError(enabled bool) OptionFunc {
+	return func(c *cache) error {
+		c.serveOnError = enabled
+		return nil
+	}
+}
+
+// WithBadRequestHandler lets h answer requests with malformed paths, in
+// place of a plain 400 carrying err.
+func WithBadRequestHandler(h func(w http.ResponseWriter, r *http.Request, err error)) OptionFunc {
+	return func(c *cache) error {
+		if h == nil {
+			return errors.New("bad request handler must not be nil")
 		}
+		c.badRequestHandler = h
+		return nil
+	}
+}
+
+func (c *cache) badRequest(w http.ResponseWriter, r *http.Request, err error) {
+	if c.badRequestHandler != nil {
+		c.badRequestHandler(w, r, err)
 		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	_, err = w.Write(b)
-	if err != nil {
-		c.l.Error(err, "error writing response")
+	w.Header().Add("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(err.Error()))
+}
+
+// WithMaxConnections limits Serve to n connections at a time. Requests on
+// connections past the limit are answered as overloaded, and the
+// connections closed.
+func WithMaxConnections(n int) OptionFunc {
+	return func(c *cache) error {
+		if n < 1 {
+			return errors.New("maximum connections must be positive")
+		}
+		c.maxConnections = n
+		return nil
 	}
 }
 
-func (c *cache) request(r *route, p []string) ([]byte, error) {
-	c.Lock()
-	if c.cache[toCanonicalPath(p)] == nil {
-		c.l.Info("cache miss", "key", p)
-		entry := &cacheEntry{}
-		c.cache[toCanonicalPath(p)] = entry
-		c.Unlock()
-		entry.Lock()
-		var err error
-		if entry.value, err = r.handler(p); err != nil {
-			c.l.Error(err, "failed to populate cache", "key", p)
-			entry.value = nil
-			entry.Unlock()
-			c.Lock()
-			delete(c.cache, toCanonicalPath(p))
-			c.Unlock()
-			return nil, err
+func WithMaxStreamRate(bytesPerSec int) OptionFunc {
+	return func(c *cache) error {
+		if bytesPerSec < 1 {
+			return errors.New("maximum stream rate must be positive")
 		}
-		entry.expiry = time.Now().Add(r.cacheRules.ttl)
-		c.l.Info("populated cache", "key", p, "expires-at", entry.expiry.Format(time.RFC3339))
-		entry.Unlock()
-	} else {
-		c.Unlock()
-		c.l.V(3).Info("cache hit", "key", p)
+		c.maxStreamRate = bytesPerSec
+		return nil
 	}
-	c.RLock()
-	entry := c.cache[toCanonicalPath(p)]
-	c.RUnlock()
-	entry.RLock()
-	rValue := entry.value
-	defer entry.RUnlock()
-	if rValue == nil {
-		c.l.Info("empty cache value", "key", p)
-		return nil, errors.New("cache entry found, but no value stored, try again later")
-	}
-	if entry.expiry.Before(time.Now()) {
-		c.l.Info("stale cache entry, will renew", "key", p, "expires-at", entry.expiry.Format(time.RFC3339))
-		go func() {
-			entry.Lock()
-			defer entry.Unlock()
-			newBytes, err := r.handler(p)
-			if err != nil {
-				c.l.Error(err, "cache renewal failed", "key", p)
-				return
-			}
-			entry.value = newBytes
-			entry.expiry = time.Now().Add(r.cacheRules.ttl)
-		}()
+}
+
+// WithClientCacheControl sends a Cache-Control header made of directive
+// and a max-age matching the time left until the entry expires. Responses
+// that are not kept in the cache get no-store instead.
+func WithClientCacheControl(directive string) OptionFunc {
+	return func(c *cache) error {
+		if directive == "" {
+			return errors.New("cache control directive must not be empty")
+		}
+		c.clientCacheControl = directive
+		return nil
 	}
-	return rValue, nil
 }
 
-func (c *cache) ListenAndServe(addr string) error {
-	srv := http.Server{}
-	srv.Addr = addr
-	srv.Handler = c
-	return srv.ListenAndServe()
+func WithLogger(l logr.Logger) OptionFunc {
+	return func(c *cache) error {
+		c.l = l
+		return nil
+	}
 }
 
-func (c *cache) lookup(path []string) *route {
-	r := c.root
-	for _, p := range path {
-		if p == "" {
-			continue
+type RouteOptionFunc func(r *route) error
+
+func WithAcceptVariants(mediaTypes ...string) RouteOptionFunc {
+	return func(r *route) error {
+		if len(mediaTypes) == 0 {
+			return errors.New("at least one accept variant is required")
 		}
-		candidate := r.dynamicChild
-		for child := range r.staticChildren {
-			if p == child {
-				candidate = r.staticChildren[child]
-				break
+		for _, t := range mediaTypes {
+			if _, _, err := mime.ParseMediaType(t); err != nil {
+				return err
 			}
 		}
-		if candidate == nil {
-			break
+		r.acceptVariants = mediaTypes
+		return nil
+	}
+}
+
+// WithVaryCookie keys the route's entries on the value of the named cookie.
+// Requests without the cookie share one entry.
+func WithVaryCookie(name string) RouteOptionFunc {
+	return func(r *route) error {
+		if name == "" {
+			return errors.New("cookie name must not be empty")
 		}
-		r = candidate
+		r.varyCookie = name
+		return nil
 	}
-	return r
 }
 
-func fromPath(p string) ([]string, error) {
-	out := make([]string, 0, 8)
-	for _, segment := range strings.Split(p, "/") {
-		if segment == "" {
-			continue
+// WithAuth refuses requests for which allow returns false before the cache
+// or the handler is consulted. They are answered with 401 and challenge as
+// WWW-Authenticate, such as `Bearer realm="api"`, or with 403 if challenge
+// is empty, as a 401 must say how to authenticate.
+func WithAuth(allow func(r *http.Request) bool, challenge string) RouteOptionFunc {
+	return func(r *route) error {
+		if allow == nil {
+			return errors.New("auth func must not be nil")
 		}
-		elem, err := url.PathUnescape(segment)
-		if err != nil {
-			return nil, err
+		r.auth = allow
+		r.authChallenge = challenge
+		return nil
+	}
+}
+
+// WithContentDisposition serves the route's responses as attachments named
+// by name, unless the handler sets Content-Disposition itself.
+func WithContentDisposition(name func(path []string) string) RouteOptionFunc {
+	return func(r *route) error {
+		if name == nil {
+			return errors.New("content disposition name func must not be nil")
 		}
-		out = append(out, elem)
+		r.contentDisposition = name
+		return nil
 	}
-	return out, nil
+}
+
+// WithResponseTransform rewrites the body returned by the route's handler,
+// such as to minify or redact it, before it is cached. Transforms run in the
+// order they are given, and a streamed body is read in full first.
+func WithResponseTransform(transform func(body []byte) ([]byte, error)) RouteOptionFunc {
+	return func(r *route) error {
+		if transform == nil {
+			return errors.New("response transform must not be nil")
+		}
+		// The route may share its transforms with the one being replaced.
+		r.transforms = append(r.transforms[:len(r.transforms):len(r.transforms)], transform)
+		return nil
+	}
+}
+
+// WithDeprecation marks the route as deprecated, adding Deprecation and
+// Sunset headers to its responses and logging message for every request.
+func WithDeprecation(sunset time.Time, message string) RouteOptionFunc {
+	return func(r *route) error {
+		r.sunset = sunset
+		r.deprecation = message
+		r.deprecated = true
+		return nil
+	}
+}
+
+// WithRouteMeta attaches metadata, such as a description, to the route for
+// Routes to report.
+func WithRouteMeta(meta map[string]string) RouteOptionFunc {
+	return func(r *route) error {
+		merged := make(map[string]string, len(r.meta)+len(meta))
+		for k, v := range r.meta {
+			merged[k] = v
+		}
+		for k, v := range meta {
+			merged[k] = v
+		}
+		r.meta = merged
+		return nil
+	}
+}
+
+// maxKeyedBodySize bounds the request bodies read by WithBodyInKey.
+const maxKeyedBodySize = 1 << 20
+
+// WithBodyInKey keys the route's entries on a hash of the request body, so
+// that identical payloads share an entry. Handlers get the body from
+// BodyFromContext. Bodies over 1 MiB are rejected with 413.
+func WithBodyInKey() RouteOptionFunc {
+	return func(r *route) error {
+		r.bodyInKey = true
+		return nil
+	}
+}
+
+// WithKeySegments keys the route's entries on the path segments at the
+// given positions only, so that paths differing elsewhere share an entry.
+// Positions past the end of a path are ignored.
+func WithKeySegments(indices ...int) RouteOptionFunc {
+	return func(r *route) error {
+		for _, i := range indices {
+			if i < 0 {
+				return fmt.Errorf("negative segment index %d", i)
+			}
+		}
+		r.keySegments = append([]int{}, indices...)
+		return nil
+	}
+}
+
+// segmentKey derives the cache key from the segments selected by
+// WithKeySegments, qualified by the route so that it cannot collide with
+// the key of a whole path.
+func (c *cache) segmentKey(r *route, path []string, dynamic []bool) string {
+	var selected []string
+	var selectedDynamic []bool
+	for _, i := range r.keySegments {
+		if i >= len(path) {
+			continue
+		}
+		selected = append(selected, path[i])
+		selectedDynamic = append(selectedDynamic, i >= len(dynamic) || dynamic[i])
+	}
+	return withKeyParam(c.cacheKey(selected, selectedDynamic), "route", r.pattern)
+}
+
+// WithMaxRequestBody limits request bodies to n bytes. Requests whose
+// Content-Length exceeds it are answered with 413 straight away. Bodies of
+// unknown length are only checked as they are read, so reading past the
+// limit fails, and WithBodyInKey, which reads the body before the handler
+// runs, answers 413 too.
+func WithMaxRequestBody(n int64) RouteOptionFunc {
+	return func(r *route) error {
+		if n < 1 {
+			return errors.New("maximum request body must be positive")
+		}
+		r.maxRequestBody = n
+		return nil
+	}
+}
+
+// WithRouteKeyFunc derives the cache key of the route's requests from f
+// instead of the request path, so that, for example, many paths can share
+// one entry.
+func WithRouteKeyFunc(f func(r *http.Request, path []string) string) RouteOptionFunc {
+	return func(r *route) error {
+		r.keyFunc = f
+		return nil
+	}
+}
+
+func WithSyncRevalidation() RouteOptionFunc {
+	return func(r *route) error {
+		r.cacheRules.syncRevalidation = true
+		return nil
+	}
+}
+
+func WithColdFallback(value []byte) RouteOptionFunc {
+	return func(r *route) error {
+		if value == nil {
+			return errors.New("cold fallback must not be nil")
+		}
+		r.coldFallback = value
+		return nil
+	}
+}
+
+func New(options ...OptionFunc) *cache {
+	c := &cache{contentType: "application/json", now: time.Now, newHash: sha256.New}
+	for _, o := range options {
+		if err := o(c); err != nil {
+			panic(err)
+		}
+	}
+	if c.minTTL > 0 && c.maxTTL > 0 && c.minTTL > c.maxTTL {
+		panic(fmt.Errorf("minimum TTL %v exceeds maximum TTL %v", c.minTTL, c.maxTTL))
+	}
+	if c.maxEntries == 0 && c.evictionPolicy != nil {
+		panic(errors.New("an eviction policy requires a maximum number of entries"))
+	}
+	if c.maxEntries > 0 && c.evictionPolicy == nil {
+		c.evictionPolicy = NewLRU()
+	}
+	c.defaultPartition = &partition{maxEntries: c.maxEntries, policy: c.evictionPolicy, sizes: make(map[string]int64)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.root = newRoute()
+	c.root.cacheRules = c.cacheRules
+	c.cache = make(map[string]*cacheEntry)
+	c.tags = make(map[string]map[string]struct{})
+	c.keyTags = make(map[string][]string)
+	c.publishExpvar()
+	return c
+}
+
+func newRoute() *route {
+	r := &route{}
+	r.staticChildren = make(map[string]*route)
+	return r
+}
+
+func (r *route) getOrCreateChild(segment string) (*route, error) {
+	if segment == "" {
+		return r, nil
+	}
+	if segment == "*" || strings.HasPrefix(segment, ":") {
+		constraint, err := parseConstraint(segment)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range r.dynamicChildren {
+			if sameConstraint(constraint, child.constraint) {
+				return child, nil
+			}
+		}
+		child := newRoute()
+		child.cacheRules = r.cacheRules
+		child.constraint = constraint
+		child.segment = segment
+		// Constrained children are tried in registration order, and the
+		// unconstrained one, if any, always last.
+		n := len(r.dynamicChildren)
+		if constraint != nil && n > 0 && r.dynamicChildren[n-1].constraint == nil {
+			r.dynamicChildren = append(r.dynamicChildren[:n-1], child, r.dynamicChildren[n-1])
+		} else {
+			r.dynamicChildren = append(r.dynamicChildren, child)
+		}
+		return child, nil
+	}
+	if _, ok := r.staticChildren[segment]; !ok {
+		r.staticChildren[segment] = newRoute()
+		r.staticChildren[segment].cacheRules = r.cacheRules
+	}
+	return r.staticChildren[segment], nil
+}
+
+// child returns the existing child for segment, as getOrCreateChild would.
+func (r *route) child(segment string) *route {
+	if segment == "" {
+		return r
+	}
+	if segment == "*" || strings.HasPrefix(segment, ":") {
+		constraint, err := parseConstraint(segment)
+		if err != nil {
+			return nil
+		}
+		for _, child := range r.dynamicChildren {
+			if sameConstraint(constraint, child.constraint) {
+				return child
+			}
+		}
+		return nil
+	}
+	return r.staticChildren[segment]
+}
+
+// find returns the route registered for segments, if any.
+func (r *route) find(segments []string) *route {
+	for _, s := range segments {
+		if r = r.child(s); r == nil {
+			return nil
+		}
+	}
+	return r
+}
+
+// handlers counts the routes with a handler in r and below.
+func (r *route) handlers() int {
+	n := 0
+	if r.handler != nil {
+		n++
+	}
+	for _, child := range r.staticChildren {
+		n += child.handlers()
+	}
+	for _, child := range r.dynamicChildren {
+		n += child.handlers()
+	}
+	return n
+}
+
+func (r *route) removeChild(child *route) {
+	for s, n := range r.staticChildren {
+		if n == child {
+			delete(r.staticChildren, s)
+			return
+		}
+	}
+	for i, n := range r.dynamicChildren {
+		if n == child {
+			r.dynamicChildren = append(r.dynamicChildren[:i:i], r.dynamicChildren[i+1:]...)
+			return
+		}
+	}
+}
+
+// paramNames returns the parameter name of every segment, empty for static
+// segments and unnamed wildcards. Names must be unique within a pattern.
+func paramNames(segments []string) ([]string, error) {
+	names := make([]string, len(segments))
+	seen := make(map[string]bool)
+	for i, s := range segments {
+		if !strings.HasPrefix(s, ":") {
+			continue
+		}
+		name := s[1:]
+		if open := strings.IndexByte(name, '('); open >= 0 {
+			name = name[:open]
+		}
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%w: parameter %q is used more than once", ErrInvalidPath, name)
+		}
+		seen[name] = true
+		names[i] = name
+	}
+	return names, nil
+}
+
+func equalParams(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseConstraint extracts the regular expression from a dynamic segment of
+// the form ":name(expr)". Unconstrained segments ("*" or ":name") yield nil.
+func parseConstraint(segment string) (*regexp.Regexp, error) {
+	open := strings.IndexByte(segment, '(')
+	if open < 0 {
+		return nil, nil
+	}
+	if !strings.HasSuffix(segment, ")") {
+		return nil, fmt.Errorf("%w: segment %q: unterminated constraint", ErrInvalidPath, segment)
+	}
+	re, err := regexp.Compile("^(?:" + segment[open+1:len(segment)-1] + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("%w: segment %q: %w", ErrInvalidPath, segment, err)
+	}
+	return re, nil
+}
+
+func (c *cache) Register(path string, handler HandlerFunc, options ...RouteOptionFunc) error {
+	return c.RegisterContext(path, func(_ context.Context, p []string) ([]byte, error) {
+		return handler(p)
+	}, options...)
+}
+
+func (c *cache) RegisterContext(path string, handler ContextHandlerFunc, options ...RouteOptionFunc) error {
+	return c.RegisterResponse(path, func(ctx context.Context, p []string) (*Response, error) {
+		b, err := handler(ctx, p)
+		if b == nil {
+			return nil, err
+		}
+		return &Response{Body: b}, err
+	}, options...)
+}
+
+func (c *cache) RegisterResponse(path string, handler ResponseHandlerFunc, options ...RouteOptionFunc) error {
+	c.routesMu.Lock()
+	defer c.routesMu.Unlock()
+	return c.registerLocked(path, options, func(r, _ *route) {
+		r.variants = nil
+		r.handler = handler
+		r.sse = nil
+	})
+}
+
+// RegisterStatus registers a handler that responds with status and an empty
+// body, such as 204 for a health check. Informational statuses cannot end a
+// response, so status must be from 200 to 599.
+func (c *cache) RegisterStatus(path string, status int, options ...RouteOptionFunc) error {
+	if status < 200 || status > 599 {
+		return fmt.Errorf("invalid status code %d", status)
+	}
+	return c.RegisterResponse(path, func(context.Context, []string) (*Response, error) {
+		return &Response{Status: status}, nil
+	}, options...)
+}
+
+// RegisterHead registers a separate handler for HEAD requests to a route
+// that already has a handler, for responses whose headers differ from those
+// of GET. Its responses are cached apart from those of the route handler,
+// which otherwise serves HEAD requests too. The HEAD handler has the
+// options of the route handler, followed by its own options, which only
+// apply to HEAD requests.
+func (c *cache) RegisterHead(path string, handler ResponseHandlerFunc, options ...RouteOptionFunc) error {
+	segments, err := c.parsePath(path)
+	if err != nil {
+		return err
+	}
+	c.routesMu.Lock()
+	defer c.routesMu.Unlock()
+	r := c.root.find(segments)
+	if r == nil || r.handler == nil {
+		return fmt.Errorf("cannot register a HEAD handler for %s, which has no handler", path)
+	}
+	head, err := c.headRoute(r, handler, options)
+	if err != nil {
+		return err
+	}
+	r.head, r.headHandler, r.headOptions = head, handler, options
+	return nil
+}
+
+// headRoute returns the route serving HEAD requests to r with handler.
+func (c *cache) headRoute(r *route, handler ResponseHandlerFunc, options []RouteOptionFunc) (*route, error) {
+	head := *r
+	head.staticChildren, head.dynamicChildren = nil, nil
+	head.head, head.headHandler, head.headOptions = nil, nil, nil
+	head.variants, head.sse = nil, nil
+	head.handler = handler
+	for _, o := range options {
+		if err := o(&head); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkPartition(&head); err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+// registerLocked registers the route for path. Options are applied to a new
+// route, which set then gives its handler, so that registering a path again
+// replaces all that its previous registration set up except its HEAD
+// handler, which is given the new options. The new route only replaces the
+// old one in the tree once all of it is valid, so that a failed registration
+// leaves the tree as it was. The caller holds routesMu.
+func (c *cache) registerLocked(path string, options []RouteOptionFunc, set func(r, existing *route)) error {
+	segments, err := c.parsePath(path)
+	if err != nil {
+		return err
+	}
+	params, err := paramNames(segments)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s == "*" || strings.HasPrefix(s, ":") {
+			if _, err := parseConstraint(s); err != nil {
+				return err
+			}
+		}
+	}
+	existing := c.root.find(segments)
+	if existing != nil && existing.handler != nil && !equalParams(existing.params, params) {
+		return fmt.Errorf("%w: %s conflicts with %s, which names its parameters differently", ErrConflictingRoute, path, existing.pattern)
+	}
+	if c.maxRoutes > 0 && (existing == nil || existing.handler == nil) && c.root.handlers() >= c.maxRoutes {
+		return fmt.Errorf("cannot register %s: at most %d routes may be registered", path, c.maxRoutes)
+	}
+	r := route{cacheRules: c.cacheRules}
+	r.params = params
+	r.pattern = "/" + strings.Join(segments, "/")
+	for _, o := range options {
+		if err := o(&r); err != nil {
+			return err
+		}
+	}
+	if err := c.checkPartition(&r); err != nil {
+		return err
+	}
+	set(&r, existing)
+	if existing != nil && existing.headHandler != nil {
+		if r.head, err = c.headRoute(&r, existing.headHandler, existing.headOptions); err != nil {
+			return err
+		}
+		r.headHandler, r.headOptions = existing.headHandler, existing.headOptions
+	}
+	node := c.root
+	for _, s := range segments {
+		if node, err = node.getOrCreateChild(s); err != nil {
+			return err
+		}
+	}
+	replaceRoute(node, &r)
+	return nil
+}
+
+// replaceRoute publishes r in place of node, keeping node's place in the
+// tree and its children.
+func replaceRoute(node, r *route) {
+	r.staticChildren, r.dynamicChildren = node.staticChildren, node.dynamicChildren
+	r.constraint, r.segment = node.constraint, node.segment
+	*node = *r
+}
+
+func (c *cache) checkPartition(r *route) error {
+	if _, ok := c.partitions[r.partition]; r.partition != "" && !ok {
+		return fmt.Errorf("unknown partition %q", r.partition)
+	}
+	if r.partition != "" && r.cardinality != nil {
+		return errors.New("a route with a maximum dynamic cardinality cannot be in a partition")
+	}
+	return nil
+}
+
+// RegisterRenewal registers a handler that is given the previously cached
+// value and its expiry when renewing an entry. Both are zero on a miss.
+func (c *cache) RegisterRenewal(path string, handler RenewalHandlerFunc, options ...RouteOptionFunc) error {
+	return c.RegisterContext(path, func(ctx context.Context, p []string) ([]byte, error) {
+		prev, _ := ctx.Value(previousKey).(entryData)
+		return handler(ctx, p, prev.value, prev.expiry)
+	}, options...)
+}
+
+// RegisterMany registers handler with options for each of paths. If one of
+// them fails to register, the paths before it are restored to what they
+// were and its error is returned.
+func (c *cache) RegisterMany(paths []string, handler HandlerFunc, options ...RouteOptionFunc) error {
+	h := func(_ context.Context, p []string) (*Response, error) {
+		b, err := handler(p)
+		if b == nil {
+			return nil, err
+		}
+		return &Response{Body: b}, err
+	}
+	c.routesMu.Lock()
+	defer c.routesMu.Unlock()
+	segments := make([][]string, 0, len(paths))
+	previous := make([]*route, 0, len(paths))
+	for i, path := range paths {
+		s, err := c.parsePath(path)
+		var prev *route
+		if err == nil {
+			if r := c.root.find(s); r != nil && r.handler != nil {
+				saved := *r
+				prev = &saved
+			}
+			err = c.registerLocked(path, options, func(r, _ *route) {
+				r.handler = h
+			})
+		}
+		if err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if previous[j] != nil {
+					replaceRoute(c.root.find(segments[j]), previous[j])
+				} else {
+					c.unregisterLocked(paths[j], segments[j])
+				}
+			}
+			return err
+		}
+		segments, previous = append(segments, s), append(previous, prev)
+	}
+	return nil
+}
+
+func (c *cache) RegisterOrDie(path string, handler HandlerFunc, options ...RouteOptionFunc) {
+	if err := c.Register(path, handler, options...); err != nil {
+		panic(err)
+	}
+}
+
+func (c *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.enter()
+	defer c.leave()
+	start := c.now()
+	if c.rewrite != nil {
+		r = r.Clone(r.Context())
+		c.rewrite(r)
+	}
+	if c.debugPath != "" && r.URL.Path == c.debugPath {
+		c.serveDebug(w)
+		return
+	}
+	if c.requestIDHeader != "" {
+		id := r.Header.Get(c.requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(c.requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, loggerKey, c.l.WithValues("request-id", id))
+		r = r.WithContext(ctx)
+	}
+	if c.writeTimeout > 0 {
+		// The server stops accepting the response at this point anyway, so
+		// handlers may as well give up too.
+		ctx, cancel := context.WithTimeout(r.Context(), c.writeTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	depth := depthFromContext(r.Context()) + 1
+	r = r.WithContext(context.WithValue(r.Context(), depthKey, depth))
+	if c.maxStreamRate > 0 {
+		w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), rate: c.maxStreamRate}
+	}
+	rw := &responseWriter{ResponseWriter: w}
+	if c.accessLog != nil {
+		defer c.logAccess(r, rw, start)
+	}
+	if c.maxRecursionDepth > 0 && depth > c.maxRecursionDepth {
+		c.logger(r.Context()).Info("maximum recursion depth exceeded", "path", r.URL.EscapedPath(), "depth", depth)
+		rw.Header().Add("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusLoopDetected)
+		rw.Write([]byte(ErrLoopDetected.Error()))
+	} else {
+		c.serve(rw, r)
+	}
+	if rw.err != nil {
+		c.counters.writeErrors.Add(1)
+		c.logger(r.Context()).Error(rw.err, "error writing response", "path", r.URL.EscapedPath(), "status", rw.status, "bytes-written", rw.written)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (c *cache) serve(w *responseWriter, r *http.Request) {
+	escaped := r.URL.EscapedPath()
+	path, err := c.parsePath(escaped)
+	if err == nil && c.strictSlashes && strings.Contains(escaped, "//") {
+		err = fmt.Errorf("%w: path contains an empty segment", ErrInvalidPath)
+	}
+	if err != nil {
+		c.badRequest(w, r, err)
+		return
+	}
+	if len(path) == 0 && c.rootRedirect != "" {
+		http.Redirect(w, r, c.rootRedirect, http.StatusFound)
+		return
+	}
+	route, dynamic := c.lookup(path)
+	if route == nil {
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no route matches " + toCanonicalPath(path)))
+		return
+	}
+	if route.auth != nil && !route.auth(r) {
+		w.Header().Add("Content-Type", "text/plain")
+		if route.authChallenge == "" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("forbidden"))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", route.authChallenge)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+	if route.deprecated {
+		w.Header().Set("Deprecation", "true")
+		if !route.sunset.IsZero() {
+			w.Header().Set("Sunset", route.sunset.UTC().Format(http.TimeFormat))
+		}
+		c.logger(r.Context()).Info("deprecated route requested", "pattern", route.pattern, "sunset", route.sunset.Format(time.RFC3339), "message", route.deprecation)
+	}
+	if !c.dependencyHealthy(w, r) {
+		return
+	}
+	if route.sse != nil {
+		c.serveSSE(w, r, route, path)
+		return
+	}
+	ctx := context.WithValue(r.Context(), routeKey, routeMatch{kind: routeKind(path, dynamic), pattern: route.pattern})
+	ctx = context.WithValue(ctx, paramsKey, route.paramValues(path))
+	key := c.routeKey(r, route, path, dynamic)
+	if c.varyHost {
+		key = withKeyParam(key, "host", strings.ToLower(r.Host))
+	}
+	if route.maxRequestBody > 0 {
+		if r.ContentLength > route.maxRequestBody {
+			w.Header().Add("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte("request body too large"))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, route.maxRequestBody)
+	}
+	if route.bodyInKey {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxKeyedBodySize+1))
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		if err == nil && len(body) > maxKeyedBodySize {
+			err = errors.New("request body too large")
+			status = http.StatusRequestEntityTooLarge
+		}
+		if err != nil {
+			w.Header().Add("Content-Type", "text/plain")
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		ctx = context.WithValue(ctx, bodyKey, body)
+		key = withKeyParam(key, "body", strings.Trim(c.etag(body), `"`))
+	}
+	if r.Method == http.MethodHead && route.head != nil {
+		route = route.head
+		key = withKeyParam(key, "method", http.MethodHead)
+	}
+	if route.varyCookie != "" {
+		w.Header().Add("Vary", "Cookie")
+		if cookie, err := r.Cookie(route.varyCookie); err == nil {
+			key = withKeyParam(key, "cookie", cookie.Value)
+		}
+	}
+	if len(route.variants) > 0 {
+		i := c.pickVariant(r, route.variants)
+		ctx = context.WithValue(ctx, variantKey, i)
+		key = withKeyParam(key, "variant", strconv.Itoa(i))
+	}
+	contentType := c.contentType
+	if len(route.acceptVariants) > 0 {
+		w.Header().Add("Vary", "Accept")
+		mediaType, ok := negotiate(r.Header.Get("Accept"), route.acceptVariants)
+		if !ok {
+			w.Header().Add("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("none of the available representations are acceptable"))
+			return
+		}
+		ctx = context.WithValue(ctx, mediaTypeKey, mediaType)
+		key = withKeyParam(key, "accept", mediaType)
+		contentType = mediaType
+	}
+	if v, ok := c.variation(key); ok {
+		ctx = context.WithValue(ctx, variedKey, key)
+		key = v.key(key, r)
+	}
+	var data entryData
+	if c.trustedHeaders && c.debugBypassHeader != "" && r.Header.Get(c.debugBypassHeader) != "" {
+		data, err = c.bypass(r.WithContext(ctx), route, key, path)
+	} else {
+		data, err = c.request(r.WithContext(ctx), route, key, path)
+	}
+	if errors.Is(err, ErrNotFound) {
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, ErrLoopDetected) {
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusLoopDetected)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, ErrFillTimeout) {
+		c.overloaded(w, r, err)
+		return
+	}
+	if err != nil {
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if data.stream != nil {
+		defer data.stream.Close()
+	}
+	// Pre-compressed bodies are served as they are to clients that accept
+	// them and decompressed for everyone else, once per cached entry.
+	gzipped := data.gzipped()
+	decoded := gzipped && !acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip")
+	if decoded && data.stream != nil {
+		data.value, err = io.ReadAll(data.stream)
+		data.stream = nil
+		if err == nil {
+			data.value, err = gunzip(data.value, c.streamLimit())
+		}
+	} else if decoded {
+		var kept bool
+		if data.value, kept, err = data.decoded(c.streamLimit()); kept {
+			c.identityDecoded(key, data.identity)
+		}
+	}
+	if err != nil {
+		c.logger(ctx).Error(err, "failed to decode response", "key", key)
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if decoded {
+		if data.etag != "" {
+			data.etag = strings.TrimSuffix(data.etag, `"`) + `-identity"`
+		}
+	}
+	for k, vs := range data.header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	if gzipped {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if decoded {
+		w.Header().Del("Content-Encoding")
+	}
+	age := c.now().Sub(data.fetched)
+	if age < 0 {
+		age = 0
+	}
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if c.clientCacheControl != "" && w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", c.cacheControl(data))
+	}
+	if w.Header().Get("Content-Type") == "" && (len(data.value) > 0 || data.stream != nil) {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if data.stream != nil {
+		w.WriteHeader(data.status)
+		if err := copyFlushing(w, data.stream); err != nil && w.err == nil {
+			// The client must not mistake a truncated body for a complete
+			// one.
+			c.logger(ctx).Error(err, "failed to read streamed response", "key", key)
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if data.status == http.StatusOK {
+		// ServeContent takes care of conditional and range requests,
+		// including If-None-Match, If-Modified-Since and If-Range, and
+		// answers failed If-Match and If-Unmodified-Since preconditions
+		// with 412, whatever the method.
+		if data.etag != "" {
+			w.Header().Set("ETag", data.etag)
+		}
+		if _, ok := w.Header()["Content-Type"]; !ok {
+			// Keep ServeContent from sniffing a type for an empty body.
+			w.Header()["Content-Type"] = nil
+		}
+		http.ServeContent(w, r, "", data.modified, bytes.NewReader(data.value))
+		return
+	}
+	w.WriteHeader(data.status)
+	if data.status != http.StatusNoContent && data.status != http.StatusNotModified {
+		w.Write(data.value)
+	}
+}
+
+func (c *cache) request(req *http.Request, r *route, key string, p []string) (entryData, error) {
+	ctx := req.Context()
+	l := c.logger(ctx)
+	if isFilling(ctx, key) {
+		l.Info("handler requested the key it is populating", "key", key)
+		return entryData{}, fmt.Errorf("%w: %s", ErrLoopDetected, key)
+	}
+	c.Lock()
+	entry, ok := c.cache[key]
+	if !ok {
+		c.counters.misses.Add(1)
+		if c.metrics != nil {
+			c.metrics.OnMiss(key)
+		}
+		l.Info("cache miss", "key", key)
+		entry = newCacheEntry()
+		entry.partition = c.routePartition(r)
+		evicted := c.insertLocked(key, entry)
+		c.Unlock()
+		c.reportEvicted(evicted, EvictCapacity)
+		// An entry loaded from the store is served like a hit below,
+		// including renewal if it is stale.
+		if !c.load(ctx, key, entry) {
+			if c.synchronous || r.coldFallback == nil && c.fillWaitTimeout == 0 {
+				return c.fillFor(req, r, key, p, entry)
+			}
+			if !c.background(func() { c.fill(req, r, key, p, entry, false) }) {
+				return c.fillFor(req, r, key, p, entry)
+			}
+		}
+	} else {
+		c.accessedLocked(key, entry)
+		c.Unlock()
+		c.counters.hits.Add(1)
+		if c.metrics != nil {
+			c.metrics.OnHit(key)
+		}
+		l.V(3).Info("cache hit", "key", key)
+	}
+	if r.coldFallback != nil && !c.synchronous {
+		select {
+		case <-entry.ready:
+		default:
+			l.V(3).Info("cache entry is still being populated, serving cold fallback", "key", key)
+			return entryData{value: r.coldFallback, status: http.StatusOK, fetched: c.now(), noStore: true}, nil
+		}
+	}
+	if err := c.wait(ctx, key, entry); err != nil {
+		return entryData{}, err
+	}
+	if entry.err != nil {
+		return entryData{}, entry.err
+	}
+	entry.RLock()
+	data := entry.entryData
+	entry.RUnlock()
+	if data.expiry.Before(c.now()) {
+		tooStale := c.maxStaleAge > 0 && c.now().Sub(data.expiry) > c.maxStaleAge
+		if tooStale || c.synchronous || r.cacheRules.syncRevalidation || c.trustedHeaders && strings.EqualFold(req.Header.Get(syncHeader), "true") {
+			l.Info("stale cache entry, renewing synchronously", "key", key, "expires-at", data.expiry.Format(time.RFC3339))
+			renewed, err := c.renew(req, r, key, p, entry, data)
+			if err != nil && !tooStale && !errors.Is(err, ErrNotFound) {
+				// Like a failed background renewal, keep serving the last
+				// good value.
+				return data, nil
+			}
+			return renewed, err
+		}
+		if entry.renewing.CompareAndSwap(false, true) {
+			if !c.acquireRenewal() {
+				l.V(3).Info("too many renewals in flight, serving stale cache entry", "key", key)
+				entry.renewing.Store(false)
+				return data, nil
+			}
+			l.Info("stale cache entry, will renew", "key", key, "expires-at", data.expiry.Format(time.RFC3339))
+			renewed := make(chan struct{})
+			entry.Lock()
+			entry.renewed = renewed
+			entry.Unlock()
+			started := c.background(func() {
+				defer close(renewed)
+				defer c.releaseRenewal()
+				defer entry.renewing.Store(false)
+				c.trackRenewal(key, 1)
+				defer c.trackRenewal(key, -1)
+				c.renew(req, r, key, p, entry, data)
+			})
+			if !started {
+				close(renewed)
+				c.releaseRenewal()
+				entry.renewing.Store(false)
+			}
+		}
+		if data.purged && c.fillWaitTimeout > 0 {
+			return c.awaitRenewal(ctx, entry, data), nil
+		}
+	}
+	return data, nil
+}
+
+// awaitRenewal waits up to WithFillWaitTimeout for the renewal of a soft
+// purged entry, returning the renewed data, or the purged data if the
+// renewal is too slow or fails.
+func (c *cache) awaitRenewal(ctx context.Context, entry *cacheEntry, purged entryData) entryData {
+	entry.RLock()
+	renewed := entry.renewed
+	entry.RUnlock()
+	if renewed == nil {
+		return purged
+	}
+	timer := time.NewTimer(c.fillWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-renewed:
+	case <-timer.C:
+		return purged
+	case <-ctx.Done():
+		return purged
+	}
+	entry.RLock()
+	data := entry.entryData
+	entry.RUnlock()
+	if data.purged {
+		return purged
+	}
+	return data
+}
+
+// wait blocks until entry is populated. Waiters give up when their own
+// request is done, or after WithFillWaitTimeout, while the fill carries on
+// for everyone else.
+func (c *cache) wait(ctx context.Context, key string, entry *cacheEntry) error {
+	select {
+	case <-entry.ready:
+		return nil
+	default:
+	}
+	var timeout <-chan time.Time
+	if c.fillWaitTimeout > 0 && !c.synchronous {
+		timer := time.NewTimer(c.fillWaitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-entry.ready:
+		return nil
+	case <-timeout:
+		c.logger(ctx).Info("timed out waiting for cache entry to be populated", "key", key)
+		return fmt.Errorf("%w: %s", ErrFillTimeout, key)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fillFor fills entry for req, which stops waiting for the fill when it is
+// done, like any other waiter, while the fill carries on in the background.
+// Without background renewal the fill runs in the caller instead, which then
+// waits for the handler either way.
+func (c *cache) fillFor(req *http.Request, r *route, key string, p []string, entry *cacheEntry) (entryData, error) {
+	if c.synchronous {
+		return c.fill(req, r, key, p, entry, true)
+	}
+	type result struct {
+		data entryData
+		err  error
+	}
+	ctx := req.Context()
+	results := make(chan result)
+	started := c.background(func() {
+		data, err := c.fill(req, r, key, p, entry, true)
+		select {
+		case results <- result{data, err}:
+		case <-ctx.Done():
+			// Nobody reads the stream, so read it into the entry.
+			if data.stream != nil {
+				data.stream.Close()
+			}
+		}
+	})
+	if !started {
+		return c.fill(req, r, key, p, entry, true)
+	}
+	select {
+	case res := <-results:
+		return res.data, res.err
+	case <-ctx.Done():
+		return entryData{}, ctx.Err()
+	}
+}
+
+// fill populates a new entry and then releases everyone waiting on it. An
+// entry that could not be populated, or that the cache policy declined, is
+// removed again, but waiters still get the outcome of the attempt. If stream
+// is set, a streamed response is returned to the caller as it arrives, and
+// the entry is populated once the caller has read it. The handler runs
+// detached from req, so that the fill is not cut short for the waiters when
+// the client that started it goes away, but within the deadline of req, such
+// as the one set by WithWriteTimeout.
+func (c *cache) fill(req *http.Request, r *route, key string, p []string, entry *cacheEntry, stream bool) (entryData, error) {
+	ctx, cancel := c.detach(req.Context()), context.CancelFunc(func() {})
+	if deadline, ok := req.Context().Deadline(); ok {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	req = req.WithContext(ctx)
+	start := c.now()
+	resp, err := c.call(withFilling(ctx, key), r, p)
+	c.handlerDone(ctx, key, start)
+	if resp != nil && resp.Stream != nil {
+		if err == nil && stream {
+			return c.fillStream(req, r, key, p, entry, resp, cancel), nil
+		}
+		body, readErr := readStream(resp.Stream, c.streamLimit())
+		if err == nil {
+			resp.Body, err = body, readErr
+		}
+	}
+	defer cancel()
+	return c.complete(req, r, key, p, entry, resp, err)
+}
+
+// bypass answers a request from the handler without reading or storing any
+// cache entry.
+func (c *cache) bypass(req *http.Request, r *route, key string, p []string) (entryData, error) {
+	c.logger(req.Context()).Info("bypassing cache for debugging", "key", key)
+	start := c.now()
+	resp, err := c.call(withFilling(req.Context(), key), r, p)
+	c.handlerDone(req.Context(), key, start)
+	if c.partial(resp, err) {
+		err = nil
+	}
+	if err == nil && resp == nil {
+		err = ErrNotFound
+	}
+	if err != nil {
+		if resp != nil && resp.Stream != nil {
+			resp.Stream.Close()
+		}
+		return entryData{}, err
+	}
+	data := c.routeEntryData(r, p, resp)
+	data.noStore = true
+	if resp.Stream != nil {
+		data.etag = ""
+		data.stream = resp.Stream
+	}
+	return data, nil
+}
+
+func (c *cache) fillStream(req *http.Request, r *route, key string, p []string, entry *cacheEntry, resp *Response, cancel context.CancelFunc) entryData {
+	data := c.newEntryData(&Response{Header: resp.Header, Status: resp.Status}, r.cacheRules.ttl)
+	data.etag = ""
+	data.stream = &streamBody{src: resp.Stream, max: c.streamLimit(), done: func(body []byte, err error) {
+		defer cancel()
+		resp.Body = body
+		c.complete(req, r, key, p, entry, resp, err)
+	}}
+	return data
+}
+
+// complete stores the outcome of a fill and releases the waiters.
+func (c *cache) complete(req *http.Request, r *route, key string, p []string, entry *cacheEntry, resp *Response, err error) (entryData, error) {
+	l := c.logger(req.Context())
+	defer close(entry.ready)
+	partial := c.partial(resp, err)
+	if partial {
+		l.Error(err, "handler failed but returned a value, serving it uncached", "key", key)
+		err = nil
+	}
+	if err == nil && resp == nil {
+		err = ErrNotFound
+	}
+	if errors.Is(err, ErrNotFound) {
+		l.V(3).Info("handler reported no value", "key", key)
+		entry.err = err
+		c.remove(key, entry)
+		return entryData{}, err
+	}
+	if err != nil {
+		l.Error(err, "failed to populate cache", "key", key)
+		entry.err = err
+		c.remove(key, entry)
+		return entryData{}, err
+	}
+	data := c.routeEntryData(r, p, resp)
+	data.noStore = partial || !c.cacheable(req, p, resp)
+	entry.Lock()
+	entry.entryData = data
+	entry.Unlock()
+	if data.noStore {
+		l.V(3).Info("cache policy declined to store response", "key", key)
+		c.remove(key, entry)
+		return data, nil
+	}
+	if len(resp.Vary) > 0 || resp.VariantKey != "" || req.Context().Value(variedKey) != nil {
+		key = c.vary(req, key, entry, resp)
+	}
+	tags := c.responseTags(resp)
+	c.resized(key, entry)
+	c.tag(key, entry, tags)
+	if c.current(key, entry) {
+		c.save(req.Context(), key, data, tags)
+	}
+	l.Info("populated cache", "key", key, "expires-at", data.expiry.Format(time.RFC3339))
+	return data, nil
+}
+
+// routeEntryData builds the entry data for a response of r.
+func (c *cache) routeEntryData(r *route, p []string, resp *Response) entryData {
+	data := c.newEntryData(resp, c.ttl(r, p, resp))
+	if r.contentDisposition != nil && data.header.Get("Content-Disposition") == "" {
+		if name := r.contentDisposition(p); name != "" {
+			if data.header == nil {
+				data.header = make(http.Header)
+			}
+			data.header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		}
+	}
+	if len(resp.Vary) > 0 {
+		if data.header == nil {
+			data.header = make(http.Header)
+		}
+		data.header["Vary"] = append(data.header["Vary"], resp.Vary...)
+	}
+	return data
+}
+
+// partial reports whether a handler that failed but still returned resp
+// should have it served, as enabled by WithServeOnError.
+func (c *cache) partial(resp *Response, err error) bool {
+	return c.serveOnError && err != nil && resp != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, errBodyTooLarge)
+}
+
+// call runs the route handler and its response transforms, turning a panic
+// into an error so that a failed fill still releases its waiters and a
+// failed renewal leaves the entry as it was.
+func (c *cache) call(ctx context.Context, r *route, p []string) (resp *Response, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("handler panicked: %v", v)
+		}
+	}()
+	resp, err = r.handler(ctx, p)
+	if errors.Is(err, ErrNoContent) {
+		return &Response{Status: http.StatusNoContent}, nil
+	}
+	if resp == nil || err != nil || len(r.transforms) == 0 {
+		return resp, err
+	}
+	t := *resp
+	if t.Stream != nil {
+		t.Body, err = readStream(t.Stream, c.streamLimit())
+		t.Stream = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, transform := range r.transforms {
+		if t.Body, err = transform(t.Body); err != nil {
+			return nil, fmt.Errorf("failed to transform response: %w", err)
+		}
+	}
+	return &t, nil
+}
+
+// notModifiedTTL returns the TTL of resp, returned along with ErrNotModified.
+func notModifiedTTL(resp *Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	return resp.TTL
+}
+
+// handlerDone records how long a handler call started at start took.
+func (c *cache) handlerDone(ctx context.Context, key string, start time.Time) {
+	d := c.now().Sub(start)
+	if c.metrics != nil {
+		c.metrics.OnHandlerDuration(key, d)
+	}
+	if c.slowHandlerThreshold > 0 && d > c.slowHandlerThreshold {
+		c.logger(ctx).Info("slow handler", "key", key, "duration", d.String())
+	}
+}
+
+// renew runs the handler for a stale entry without holding the entry lock,
+// so readers keep being served the old value in the meantime.
+func (c *cache) renew(req *http.Request, r *route, key string, p []string, entry *cacheEntry, prev entryData) (_ entryData, err error) {
+	if c.metrics != nil {
+		defer func() { c.metrics.OnRenew(key, err) }()
+	}
+	ctx := context.WithValue(c.detach(req.Context()), versionKey, prev.etag)
+	ctx = context.WithValue(ctx, previousKey, prev)
+	l := c.logger(ctx)
+	start := c.now()
+	// A panicking handler fails the renewal like an error, so the entry
+	// keeps serving its previous value.
+	resp, err := c.call(ctx, r, p)
+	c.handlerDone(ctx, key, start)
+	if resp != nil && resp.Stream != nil {
+		body, readErr := readStream(resp.Stream, c.streamLimit())
+		if err == nil {
+			resp.Body, err = body, readErr
+		}
+	}
+	if errors.Is(err, ErrNotModified) {
+		entry.RLock()
+		ttl := c.ttl(r, p, &Response{Body: entry.value, Header: entry.header, Status: entry.status, TTL: notModifiedTTL(resp)})
+		entry.RUnlock()
+		entry.Lock()
+		now := c.now()
+		entry.fetched = now
+		entry.expiry = now.Add(c.clampTTL(ttl))
+		entry.purged = false
+		data := entry.entryData
+		entry.Unlock()
+		c.RLock()
+		tags, current := c.keyTags[key], c.cache[key] == entry
+		c.RUnlock()
+		if current {
+			c.save(ctx, key, data, tags)
+		}
+		l.V(3).Info("cache entry not modified, extended expiry", "key", key, "expires-at", data.expiry.Format(time.RFC3339))
+		return data, nil
+	}
+	if err == nil && resp == nil {
+		err = ErrNotFound
+	}
+	if c.partial(resp, err) {
+		l.Error(err, "renewal failed but returned a value, serving it uncached", "key", key)
+		data := c.routeEntryData(r, p, resp)
+		data.noStore = true
+		return data, nil
+	}
+	if errors.Is(err, ErrNotFound) {
+		l.V(3).Info("handler reported no value on renewal, dropping entry", "key", key)
+		if c.remove(key, entry) {
+			c.evicted(key, entry, EvictDropped)
+		}
+		return entryData{}, err
+	}
+	if err != nil {
+		l.Error(err, "cache renewal failed", "key", key)
+		return entryData{}, err
+	}
+	data := c.routeEntryData(r, p, resp)
+	if data.etag == prev.etag {
+		data.modified = prev.modified
+	}
+	if !c.cacheable(req, p, resp) {
+		l.V(3).Info("cache policy declined to store renewed response", "key", key)
+		if c.remove(key, entry) {
+			c.evicted(key, entry, EvictDropped)
+		}
+		data.noStore = true
+		return data, nil
+	}
+	entry.Lock()
+	entry.entryData = data
+	entry.Unlock()
+	if resp.VariantKey != "" || req.Context().Value(variedKey) != nil {
+		key = c.vary(req, key, entry, resp)
+	}
+	tags := c.responseTags(resp)
+	c.resized(key, entry)
+	c.tag(key, entry, tags)
+	if c.current(key, entry) {
+		c.save(ctx, key, data, tags)
+	}
+	return data, nil
+}
+
+// current reports whether key still maps to entry, so that a fill does not
+// overwrite in the store a value that replaced it, such as one given to Set.
+func (c *cache) current(key string, entry *cacheEntry) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cache[key] == entry
+}
+
+// remove deletes key from the cache if it still maps to entry, so that a
+// slow request cannot drop an entry that replaced the one it was filling.
+func (c *cache) remove(key string, entry *cacheEntry) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.cache[key] != entry {
+		return false
+	}
+	delete(c.cache, key)
+	c.untagLocked(key)
+	c.forgetLocked(key, entry)
+	c.unvaryLocked(key)
+	return true
+}
+
+// Set caches value for path as if its handler had returned it, replacing any
+// existing entry. It expires after ttl. Routes whose entries are keyed by
+// more than the path, such as by host, cookie, Accept header, request body
+// or variant, or by a key function, cannot be set.
+func (c *cache) Set(path string, value []byte, ttl time.Duration) error {
+	key, r, err := c.pathKey(path)
+	if err != nil {
+		return err
+	}
+	entry := newCacheEntry()
+	if r != nil {
+		if c.varyHost || r.keyFunc != nil || r.varyCookie != "" || r.bodyInKey || len(r.variants) > 0 || len(r.acceptVariants) > 0 {
+			return fmt.Errorf("cannot set %s: its route keys entries by more than the path", path)
+		}
+		entry.partition = c.routePartition(r)
+	}
+	if _, ok := c.variation(key); ok {
+		return fmt.Errorf("cannot set %s: its responses vary by request headers", path)
+	}
+	entry.entryData = c.newEntryData(&Response{Body: value}, ttl)
+	close(entry.ready)
+	c.Lock()
+	old, replaced := c.cache[key]
+	c.untagLocked(key)
+	evicted := c.insertLocked(key, entry)
+	c.Unlock()
+	if replaced {
+		c.evicted(key, old, EvictReplaced)
+	}
+	c.reportEvicted(evicted, EvictCapacity)
+	c.save(c.ctx, key, entry.entryData, nil)
+	return nil
+}
+
+// pathKey returns the key of the entry for path, before any variants, as
+// serve derives it for a GET request for path without headers, along with
+// the route matching path, if any.
+func (c *cache) pathKey(path string) (string, *route, error) {
+	segments, err := c.parsePath(path)
+	if err != nil {
+		return "", nil, err
+	}
+	r, dynamic := c.lookup(segments)
+	if r == nil {
+		return toCanonicalPath(segments), nil, nil
+	}
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.routeKey(req, r, segments, dynamic), r, nil
+}
+
+// routeKey derives the key of the entry for req, for path matched by r,
+// before any variants: from the key function or key segments of r if it has
+// them, or else from path.
+func (c *cache) routeKey(req *http.Request, r *route, path []string, dynamic []bool) string {
+	if r.keyFunc != nil {
+		return r.keyFunc(req, path)
+	}
+	if r.keySegments != nil {
+		return c.segmentKey(r, path, dynamic)
+	}
+	return c.cacheKey(path, dynamic)
+}
+
+// variantOf reports whether the entry under k is the entry under key or one
+// of its variants, which qualify key with parameters of their own. A route
+// parameter right after key instead makes k the key of another route with
+// WithKeySegments.
+func variantOf(k, key string) bool {
+	if k == key {
+		return true
+	}
+	sep := "?"
+	if strings.Contains(key, "?") {
+		sep = "&"
+	}
+	if !strings.HasPrefix(k, key+sep) {
+		return false
+	}
+	return !strings.HasPrefix(k[len(key+sep):], "route=")
+}
+
+// WithSoftPurge makes Purge expire entries rather than remove them. The next
+// request renews a purged entry, waiting up to WithFillWaitTimeout for the
+// renewal before it is served the purged value.
+func WithSoftPurge() OptionFunc {
+	return func(c *cache) error {
+		c.softPurge = true
+		return nil
+	}
+}
+
+// Purge removes the entries for path, keyed as a GET request for path would
+// be, including its variants by Accept, cookie or host, or just expires them
+// with WithSoftPurge.
+func (c *cache) Purge(path string) error {
+	key, _, err := c.pathKey(path)
+	if err != nil {
+		return err
+	}
+	for k, entry := range c.snapshot() {
+		if !variantOf(k, key) {
+			continue
+		}
+		if !c.softPurge {
+			if c.remove(k, entry) {
+				c.evicted(k, entry, EvictPurged)
+			}
+			continue
+		}
+		entry.Lock()
+		entry.purged = true
+		if now := c.now(); !entry.expiry.Before(now) {
+			entry.expiry = now.Add(-time.Nanosecond)
+		}
+		entry.Unlock()
+	}
+	return nil
+}
+
+// PurgeFunc removes every populated entry for which pred returns true. pred
+// runs without the cache lock held, so it may be slow.
+func (c *cache) PurgeFunc(pred func(key string, value []byte, expiry time.Time) bool) {
+	for key, entry := range c.snapshot() {
+		if !entry.populated() {
+			continue
+		}
+		entry.RLock()
+		value, expiry := entry.value, entry.expiry
+		entry.RUnlock()
+		if pred(key, value, expiry) && c.remove(key, entry) {
+			c.evicted(key, entry, EvictPurged)
+		}
+	}
+}
+
+func (c *cache) Clear() {
+	c.Lock()
+	entries := c.cache
+	for key, entry := range entries {
+		c.forgetLocked(key, entry)
+	}
+	c.cache = make(map[string]*cacheEntry)
+	c.tags = make(map[string]map[string]struct{})
+	c.keyTags = make(map[string][]string)
+	c.varies, c.variedFrom = nil, nil
+	c.Unlock()
+	for key, entry := range entries {
+		c.evicted(key, entry, EvictPurged)
+	}
+}
+
+// Close stops background renewals and fills and waits for them to return.
+// It is safe to call more than once and without ever serving.
+func (c *cache) Close() error {
+	c.closeOnce.Do(func() {
+		c.bgMu.Lock()
+		c.cancel()
+		c.bgMu.Unlock()
+		c.bg.Wait()
+	})
+	return nil
+}
+
+// background runs f in a goroutine that Close waits for. It reports false,
+// without running f, once the cache is closed.
+func (c *cache) background(f func()) bool {
+	c.bgMu.Lock()
+	defer c.bgMu.Unlock()
+	if c.ctx.Err() != nil {
+		return false
+	}
+	c.bg.Add(1)
+	go func() {
+		defer c.bg.Done()
+		f()
+	}()
+	return true
+}
+
+// acquireRenewal takes a slot for a background renewal, reporting false if
+// WithMaxRenewalGoroutines is set and all slots are taken.
+func (c *cache) acquireRenewal() bool {
+	if c.renewals == nil {
+		return true
+	}
+	select {
+	case c.renewals <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *cache) releaseRenewal() {
+	if c.renewals != nil {
+		<-c.renewals
+	}
+}
+
+func (c *cache) cacheControl(data entryData) string {
+	if data.noStore {
+		return "no-store"
+	}
+	maxAge := data.expiry.Sub(c.now()) / time.Second
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return c.clientCacheControl + ", max-age=" + strconv.FormatInt(int64(maxAge), 10)
+}
+
+func (c *cache) logger(ctx context.Context) logr.Logger {
+	if l, ok := ctx.Value(loggerKey).(logr.Logger); ok {
+		return l
+	}
+	return c.l
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// lookup resolves a request path to a copy of the most specific registered
+// route, so that a request sees the route as it was when it arrived,
+// whatever is registered meanwhile. At every segment a static child is
+// tried before the dynamic one, and a route whose subtree cannot match the
+// rest of the path catches the remaining segments itself, so the route with
+// the longest static prefix wins. Branches without any handler are
+// backtracked out of. A nil result means no route matched. With "/", "/foo"
+// and "/*" registered, "/" is served by the root handler, "/foo" by the
+// static route and any other path by the wildcard, which also catches deeper
+// paths such as "/bar/baz".
+func (c *cache) lookup(path []string) (*route, []bool) {
+	c.routesMu.RLock()
+	defer c.routesMu.RUnlock()
+	r, dynamic := c.root.match(path, make([]bool, 0, len(path)))
+	if r == nil {
+		return nil, nil
+	}
+	matched := *r
+	return &matched, dynamic
+}
+
+// Unregister removes the handler registered for the pattern path, along
+// with its variants, HEAD handler and options, so that requests it matched
+// are routed as if it had never been registered. Entries it cached are left
+// to expire or be evicted.
+func (c *cache) Unregister(path string) error {
+	segments, err := c.parsePath(path)
+	if err != nil {
+		return err
+	}
+	c.routesMu.Lock()
+	defer c.routesMu.Unlock()
+	return c.unregisterLocked(path, segments)
+}
+
+// unregisterLocked unregisters path, parsed into segments. The caller holds
+// routesMu.
+func (c *cache) unregisterLocked(path string, segments []string) error {
+	nodes := []*route{c.root}
+	for _, s := range segments {
+		child := nodes[len(nodes)-1].child(s)
+		if child == nil {
+			return fmt.Errorf("%s is not registered", path)
+		}
+		if child != nodes[len(nodes)-1] {
+			nodes = append(nodes, child)
+		}
+	}
+	r := nodes[len(nodes)-1]
+	if r.handler == nil {
+		return fmt.Errorf("%s is not registered", path)
+	}
+	replaceRoute(r, &route{cacheRules: c.cacheRules})
+	// Drop the branch it leaves without routes.
+	for i := len(nodes) - 1; i > 0; i-- {
+		n := nodes[i]
+		if n.handler != nil || len(n.staticChildren) > 0 || len(n.dynamicChildren) > 0 {
+			break
+		}
+		nodes[i-1].removeChild(n)
+	}
+	return nil
+}
+
+// match returns the matched route along with, for every segment it
+// consumed, whether that segment was matched dynamically.
+func (r *route) match(path []string, dynamic []bool) (*route, []bool) {
+	if len(path) > 0 {
+		if child, ok := r.staticChildren[path[0]]; ok {
+			if m, d := child.match(path[1:], append(dynamic, false)); m != nil {
+				return m, d
+			}
+		}
+		for _, child := range r.dynamicChildren {
+			if !child.accepts(path[0]) {
+				continue
+			}
+			if m, d := child.match(path[1:], append(dynamic, true)); m != nil {
+				return m, d
+			}
+		}
+	}
+	if r.handler != nil {
+		return r, dynamic
+	}
+	return nil, nil
+}
+
+func (r *route) paramValues(path []string) map[string]string {
+	values := make(map[string]string)
+	for i, name := range r.params {
+		if name != "" && i < len(path) {
+			values[name] = path[i]
+		}
+	}
+	return values
+}
+
+func sameConstraint(a, b *regexp.Regexp) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+func (r *route) accepts(segment string) bool {
+	return r.constraint == nil || r.constraint.MatchString(segment)
+}
+
+// parsePath splits p into segments like fromPath, normalizing them as set by
+// WithUnicodeNormalization.
+func (c *cache) parsePath(p string) ([]string, error) {
+	segments, err := fromPath(p)
+	if err != nil || c.unicodeForm == nil {
+		return segments, err
+	}
+	for i, s := range segments {
+		segments[i] = c.unicodeForm.String(s)
+	}
+	return segments, nil
+}
+
+func fromPath(p string) ([]string, error) {
+	out := make([]string, 0, 8)
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "" {
+			continue
+		}
+		elem, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBadEncoding, err)
+		}
+		out = append(out, elem)
+	}
+	return out, nil
+}
+
+// cacheKey derives the cache key for a request path. Segments past the
+// matched route are caught by it and count as dynamic. The segments are
+// already decoded, so differently encoded requests for the same path, such
+// as /a%20b and /%61%20b, share a key and coalesce on a single fill.
+func (c *cache) cacheKey(path []string, dynamic []bool) string {
+	if !c.foldDynamicCase {
+		return toCanonicalPath(path)
+	}
+	folded := make([]string, len(path))
+	for i := range path {
+		if i >= len(dynamic) || dynamic[i] {
+			folded[i] = strings.ToLower(path[i])
+		} else {
+			folded[i] = path[i]
+		}
+	}
+	return toCanonicalPath(folded)
+}
+
+func withKeyParam(key, name, value string) string {
+	sep := "?"
+	if strings.Contains(key, "?") {
+		sep = "&"
+	}
+	return key + sep + name + "=" + url.QueryEscape(value)
 }
 
 func toCanonicalPath(p []string) string {
@@ -0,0 +1,2867 @@
+package minicache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp/syntax"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	"golang.org/x/text/unicode/norm"
+)
+
+// serve sends a request for path through c and returns the recorded
+// response, with the headers given as name and value pairs.
+func serve(t *testing.T, c *cache, method, path string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Add(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r)
+	return w
+}
+
+func body(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	b, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func constant(value string) HandlerFunc {
+	return func([]string) ([]byte, error) {
+		return []byte(value), nil
+	}
+}
+
+func TestFailedRegistrationLeavesTreeUnchanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		path    string
+		route   []RouteOptionFunc
+	}{
+		{"unknown partition", nil, "/a/b/c", []RouteOptionFunc{WithPartition("nope")}},
+		{"partition with cardinality", []OptionFunc{WithPartitionLimit("p", 1, 0)}, "/a/b/c", []RouteOptionFunc{WithPartition("p"), WithMaxDynamicCardinality(1)}},
+		{"failing option", nil, "/a/b/c", []RouteOptionFunc{WithRouteMeta(map[string]string{"k": "v"}), WithMaxRequestBody(0)}},
+		{"bad constraint", nil, "/a/b/:id([)", nil},
+		{"route limit", []OptionFunc{WithMaxRoutes(1)}, "/a/b/c", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(tt.options...)
+			if err := c.Register("/a", constant("a"), WithRouteMeta(map[string]string{"k": "a"})); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Register(tt.path, constant("c"), tt.route...); err == nil {
+				t.Fatal("registration succeeded")
+			}
+			if err := c.Validate(); err != nil {
+				t.Errorf("Validate() = %v", err)
+			}
+			routes := c.Routes()
+			if len(routes) != 1 || routes[0].Pattern != "/a" || routes[0].Meta["k"] != "a" {
+				t.Errorf("Routes() = %v", routes)
+			}
+		})
+	}
+}
+
+func TestFailedReregistrationKeepsRoute(t *testing.T) {
+	c := New()
+	if err := c.Register("/a", constant("a"), WithMaxRequestBody(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register("/a", constant("b"), WithMaxRequestBody(20), WithPartition("nope")); err == nil {
+		t.Fatal("registration succeeded")
+	}
+	if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "a" {
+		t.Errorf("body = %q, want the original handler's", got)
+	}
+	r, _ := c.lookup([]string{"a"})
+	if r.maxRequestBody != 10 {
+		t.Errorf("maxRequestBody = %d, want 10", r.maxRequestBody)
+	}
+}
+
+func TestReregistrationReplacesOptions(t *testing.T) {
+	upper := WithResponseTransform(func(b []byte) ([]byte, error) {
+		return append([]byte("<"), append(b, '>')...), nil
+	})
+	c := New()
+	for i := 0; i < 3; i++ {
+		if err := c.Register("/t", constant("x"), upper); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := body(t, serve(t, c, http.MethodGet, "/t")); got != "<x>" {
+		t.Errorf("body = %q, want the transform applied once", got)
+	}
+
+	options := []RouteOptionFunc{
+		WithRouteMeta(map[string]string{"k": "v"}),
+		WithAuth(func(*http.Request) bool { return false }, ""),
+		WithMaxDynamicCardinality(1),
+		WithKeySegments(0),
+		upper,
+	}
+	tests := []struct {
+		name       string
+		unregister bool
+	}{
+		{"registered again", false},
+		{"unregistered first", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			if err := c.Register("/u/:id", constant("x"), options...); err != nil {
+				t.Fatal(err)
+			}
+			if tt.unregister {
+				if err := c.Unregister("/u/:id"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Register("/u/:id", constant("x")); err != nil {
+				t.Fatal(err)
+			}
+			r, _ := c.lookup([]string{"u", "1"})
+			if r.meta != nil || r.auth != nil || r.cardinality != nil || r.keySegments != nil || r.transforms != nil {
+				t.Errorf("options of the previous registration survived: %+v", r)
+			}
+			w := serve(t, c, http.MethodGet, "/u/1")
+			if w.Code != http.StatusOK || body(t, w) != "x" {
+				t.Errorf("got %d %q", w.Code, body(t, w))
+			}
+		})
+	}
+}
+
+func TestRegisterHead(t *testing.T) {
+	head := func(context.Context, []string) (*Response, error) {
+		return &Response{Header: http.Header{"X-Head": {"1"}}}, nil
+	}
+	get := WithRouteMeta(map[string]string{"route": "get"})
+	headOnly := WithRouteMeta(map[string]string{"route": "head"})
+
+	c := New()
+	if err := c.RegisterHead("/a", head); err == nil {
+		t.Error("RegisterHead for an unregistered path succeeded")
+	}
+	if err := c.Register("/a", constant("a"), get); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterHead("/a", head, headOnly, WithMaxRequestBody(5)); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := c.lookup([]string{"a"})
+	if r.meta["route"] != "get" || r.maxRequestBody != 0 {
+		t.Errorf("HEAD options applied to the GET route: meta %v, max body %d", r.meta, r.maxRequestBody)
+	}
+	if r.head.meta["route"] != "head" || r.head.maxRequestBody != 5 {
+		t.Errorf("HEAD route: meta %v, max body %d", r.head.meta, r.head.maxRequestBody)
+	}
+
+	// Re-registering GET rebuilds the HEAD route from the new options.
+	if err := c.Register("/a", constant("b"), WithRouteMeta(map[string]string{"k": "v"})); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = c.lookup([]string{"a"})
+	if r.head == nil || r.head.meta["k"] != "v" || r.head.meta["route"] != "head" || r.head.maxRequestBody != 5 {
+		t.Errorf("HEAD route after re-registration: %+v", r.head)
+	}
+	if w := serve(t, c, http.MethodHead, "/a"); w.Header().Get("X-Head") != "1" {
+		t.Errorf("HEAD served by the GET handler: %v", w.Header())
+	}
+	if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "b" {
+		t.Errorf("GET body = %q, want b", got)
+	}
+}
+
+func TestRegisterMany(t *testing.T) {
+	calls := make(map[string]int)
+	var mu sync.Mutex
+	handler := func(p []string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[strings.Join(p, "/")]++
+		return []byte(strings.Join(p, "/")), nil
+	}
+	c := New(WithDefaultTTL(time.Minute))
+	if err := c.RegisterMany([]string{"/a", "/b/c"}, handler, WithRouteMeta(map[string]string{"k": "v"})); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/b/c", "/a", "/b/c"} {
+		if got := body(t, serve(t, c, http.MethodGet, path)); got != path[1:] {
+			t.Errorf("GET %s = %q", path, got)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["a"] != 1 || calls["b/c"] != 1 {
+		t.Errorf("handler calls = %v, want one per path", calls)
+	}
+	for _, r := range c.Routes() {
+		if r.Meta["k"] != "v" {
+			t.Errorf("route %s has meta %v", r.Pattern, r.Meta)
+		}
+	}
+}
+
+func TestRegisterManyRollsBack(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+	}{
+		{"invalid path", []string{"/a", "/b/c", "/%zz"}},
+		{"bad constraint", []string{"/a", "/b/c", "/d/:id([)"}},
+		{"repeated path", []string{"/a", "/b/c", "/a", "/e/:id([)"}},
+		{"conflicting parameters", []string{"/b/c", "/a", "/x/:id", "/x/:name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			if err := c.Register("/a", constant("old"), WithRouteMeta(map[string]string{"k": "old"})); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.RegisterMany(tt.paths, constant("new"), WithRouteMeta(map[string]string{"k": "new"})); err == nil {
+				t.Fatal("RegisterMany succeeded")
+			}
+			routes := c.Routes()
+			if len(routes) != 1 || routes[0].Pattern != "/a" || routes[0].Meta["k"] != "old" {
+				t.Errorf("Routes() = %v", routes)
+			}
+			if err := c.Validate(); err != nil {
+				t.Errorf("Validate() = %v", err)
+			}
+			if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "old" {
+				t.Errorf("GET /a = %q, want old", got)
+			}
+			if w := serve(t, c, http.MethodGet, "/b/c"); w.Code != http.StatusNotFound {
+				t.Errorf("GET /b/c = %d, want 404", w.Code)
+			}
+		})
+	}
+}
+
+func TestHandlerErrorIsPlainText(t *testing.T) {
+	c := New()
+	if err := c.Register("/a", func([]string) ([]byte, error) { return nil, errors.New("boom") }); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(t, c, http.MethodGet, "/a")
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Type") != "text/plain" || body(t, w) != "boom" {
+		t.Errorf("got %d %v %q", w.Code, w.Header(), body(t, w))
+	}
+}
+
+// memStore is a Store kept in a map.
+type memStore struct {
+	mu      sync.Mutex
+	entries map[string]*StoredEntry
+}
+
+func (s *memStore) Get(_ context.Context, key string) (*StoredEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries[key], nil
+}
+
+func (s *memStore) Set(_ context.Context, key string, e *StoredEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]*StoredEntry)
+	}
+	s.entries[key] = e
+	return nil
+}
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		route   []RouteOptionFunc
+		wantErr bool
+	}{
+		{"plain", nil, nil, false},
+		{"host", []OptionFunc{WithVaryHost()}, nil, true},
+		{"cookie", nil, []RouteOptionFunc{WithVaryCookie("session")}, true},
+		{"accept", nil, []RouteOptionFunc{WithAcceptVariants("text/plain")}, true},
+		{"body", nil, []RouteOptionFunc{WithBodyInKey()}, true},
+		{"key function", nil, []RouteOptionFunc{WithRouteKeyFunc(func(*http.Request, []string) string { return "k" })}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithDefaultTTL(time.Minute))...)
+			if err := c.Register("/u/:id", constant("handler"), tt.route...); err != nil {
+				t.Fatal(err)
+			}
+			err := c.Set("/u/1", []byte("set"), time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set() = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if got := body(t, serve(t, c, http.MethodGet, "/u/1")); got != "set" {
+					t.Errorf("GET = %q, want set", got)
+				}
+			}
+		})
+	}
+
+	t.Run("variants", func(t *testing.T) {
+		c := New()
+		if err := c.RegisterVariant("/v", constant("a"), 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Set("/v", []byte("set"), time.Minute); err == nil {
+			t.Error("Set succeeded for a route with variants")
+		}
+	})
+
+	t.Run("key segments", func(t *testing.T) {
+		c := New(WithDefaultTTL(time.Minute))
+		if err := c.Register("/u/:id/:name", constant("handler"), WithKeySegments(1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Set("/u/1/a", []byte("set"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if got := body(t, serve(t, c, http.MethodGet, "/u/1/b")); got != "set" {
+			t.Errorf("GET = %q, want the value set for the same key segments", got)
+		}
+	})
+
+	t.Run("vary", func(t *testing.T) {
+		c := New(WithDefaultTTL(time.Minute))
+		if err := c.RegisterResponse("/r", func(context.Context, []string) (*Response, error) {
+			return &Response{Body: []byte("r"), Vary: []string{"X-Lang"}}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		serve(t, c, http.MethodGet, "/r", "X-Lang", "en")
+		if err := c.Set("/r", []byte("set"), time.Minute); err == nil {
+			t.Error("Set succeeded for a route whose responses vary")
+		}
+	})
+}
+
+func TestSetDuringFill(t *testing.T) {
+	store := &memStore{}
+	c := New(WithStore(store), WithDefaultTTL(time.Minute))
+	started, release := make(chan struct{}), make(chan struct{})
+	if err := c.Register("/a", func([]string) ([]byte, error) {
+		close(started)
+		<-release
+		return []byte("handler"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(t, c, http.MethodGet, "/a")
+	}()
+	<-started
+	if err := c.Set("/a", []byte("set"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-done
+	if e, _ := store.Get(context.Background(), "/a"); e == nil || string(e.Body) != "set" {
+		t.Errorf("stored entry = %+v, want the value given to Set", e)
+	}
+	if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "set" {
+		t.Errorf("GET = %q, want set", got)
+	}
+}
+
+// expiry returns how long after now the entry for key expires.
+func expiry(t *testing.T, c *cache, key string, now time.Time) time.Duration {
+	t.Helper()
+	c.RLock()
+	entry := c.cache[key]
+	c.RUnlock()
+	if entry == nil {
+		t.Fatalf("no entry for %s", key)
+	}
+	entry.RLock()
+	defer entry.RUnlock()
+	return entry.expiry.Sub(now)
+}
+
+func TestResponseTTL(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		ttl     time.Duration
+		want    time.Duration
+	}{
+		{"route TTL", nil, 0, time.Minute},
+		{"response TTL", nil, time.Hour, time.Hour},
+		{"clamped to maximum", []OptionFunc{WithMaxTTL(10 * time.Minute)}, time.Hour, 10 * time.Minute},
+		{"clamped to minimum", []OptionFunc{WithMinTTL(2 * time.Hour)}, time.Hour, 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithDefaultTTL(time.Minute), WithClock(func() time.Time { return now }))...)
+			if err := c.RegisterResponse("/a", func(context.Context, []string) (*Response, error) {
+				return &Response{Body: []byte("a"), TTL: tt.ttl}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			if got := expiry(t, c, "/a", now); got != tt.want {
+				t.Errorf("expires in %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModifiedTTL(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	c := New(WithDefaultTTL(time.Minute), WithClock(clock), WithoutBackgroundRenewal())
+	calls := 0
+	if err := c.RegisterResponse("/a", func(context.Context, []string) (*Response, error) {
+		calls++
+		if calls == 1 {
+			return &Response{Body: []byte("a")}, nil
+		}
+		return &Response{TTL: time.Hour}, ErrNotModified
+	}); err != nil {
+		t.Fatal(err)
+	}
+	serve(t, c, http.MethodGet, "/a")
+	mu.Lock()
+	now = now.Add(2 * time.Minute)
+	mu.Unlock()
+	if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "a" {
+		t.Errorf("GET = %q, want the kept value", got)
+	}
+	if got := expiry(t, c, "/a", clock()); got != time.Hour {
+		t.Errorf("expires in %v, want 1h", got)
+	}
+}
+
+func TestNewRejectsInvertedTTLClamp(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("New did not panic")
+		}
+	}()
+	New(WithMinTTL(time.Hour), WithMaxTTL(time.Minute))
+}
+
+func TestWithoutBackgroundRenewalWaitsForFills(t *testing.T) {
+	tests := []struct {
+		name  string
+		route []RouteOptionFunc
+	}{
+		{"fill wait timeout", nil},
+		{"cold fallback", []RouteOptionFunc{WithColdFallback([]byte("fallback"))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offset atomic.Int64
+			start := time.Now()
+			c := New(WithoutBackgroundRenewal(), WithFillWaitTimeout(time.Millisecond), WithDefaultTTL(time.Minute), WithClock(func() time.Time {
+				return start.Add(time.Duration(offset.Load()))
+			}))
+			started, release := make(chan struct{}, 2), make(chan struct{}, 2)
+			var calls atomic.Int32
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				n := calls.Add(1)
+				started <- struct{}{}
+				<-release
+				return []byte(strconv.Itoa(int(n))), nil
+			}, tt.route...); err != nil {
+				t.Fatal(err)
+			}
+			results := make(chan *httptest.ResponseRecorder, 2)
+			go func() { results <- serve(t, c, http.MethodGet, "/a") }()
+			<-started
+			go func() { results <- serve(t, c, http.MethodGet, "/a") }()
+			time.Sleep(20 * time.Millisecond)
+			release <- struct{}{}
+			for i := 0; i < 2; i++ {
+				if w := <-results; w.Code != http.StatusOK || w.Body.String() != "1" {
+					t.Errorf("got %d %q, want the filled value", w.Code, w.Body.String())
+				}
+			}
+
+			// A stale read renews on the request goroutine and answers with
+			// the renewed value rather than the stale one.
+			offset.Add(int64(time.Hour))
+			baseline := runtime.NumGoroutine()
+			go func() { results <- serve(t, c, http.MethodGet, "/a") }()
+			<-started
+			select {
+			case w := <-results:
+				t.Fatalf("stale read answered %d %q before its renewal finished", w.Code, w.Body.String())
+			case <-time.After(20 * time.Millisecond):
+			}
+			if n := runtime.NumGoroutine(); n > baseline+1 {
+				t.Errorf("%d goroutines while renewing, want at most %d", n, baseline+1)
+			}
+			if got := c.InFlightRenewals(); len(got) != 0 {
+				t.Errorf("InFlightRenewals() = %q, want none", got)
+			}
+			release <- struct{}{}
+			if w := <-results; w.Code != http.StatusOK || w.Body.String() != "2" {
+				t.Errorf("stale read = %d %q, want the renewed value", w.Code, w.Body.String())
+			}
+			if n := calls.Load(); n != 2 {
+				t.Errorf("handler called %d times, want 2", n)
+			}
+		})
+	}
+}
+
+func TestRegisterUnregisterWhileServing(t *testing.T) {
+	c := New(WithDefaultTTL(time.Millisecond))
+	if err := c.Register("/*", constant("wildcard")); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"/a", "/a/:id", "/a/b/c", "/x/:id([0-9]+)"}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		path := path
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.Register(path, constant(path), WithRouteMeta(map[string]string{"path": path}))
+				c.RegisterHead(path, func(context.Context, []string) (*Response, error) {
+					return &Response{}, nil
+				})
+				c.Validate()
+				c.Routes()
+				c.Unregister(path)
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 300; j++ {
+				for _, path := range []string{"/a", "/a/1", "/a/b/c", "/x/1", "/y"} {
+					method := http.MethodGet
+					if j%2 == 1 {
+						method = http.MethodHead
+					}
+					if w := serve(t, c, method, path); w.Code != http.StatusOK {
+						t.Errorf("%s %s = %d", method, path, w.Code)
+					}
+				}
+			}
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	if routes := c.Routes(); len(routes) != 1 || routes[0].Pattern != "/*" {
+		t.Errorf("Routes() = %v, want only the wildcard", routes)
+	}
+}
+
+func TestRootWildcardPrecedence(t *testing.T) {
+	c := New()
+	for path, value := range map[string]string{"/": "root", "/foo": "foo", "/*": "wildcard"} {
+		if err := c.Register(path, constant(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "root"},
+		{"/foo", "foo"},
+		{"/bar", "wildcard"},
+		{"/bar/baz", "wildcard"},
+		// The longest static prefix wins, catching the rest of the path.
+		{"/foo/bar", "foo"},
+	}
+	for _, tt := range tests {
+		if got := body(t, serve(t, c, http.MethodGet, tt.path)); got != tt.want {
+			t.Errorf("GET %s = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	c := New(WithDefaultTTL(time.Minute))
+	if err := c.Register("/a", constant("a")); err != nil {
+		t.Fatal(err)
+	}
+	etag := serve(t, c, http.MethodGet, "/a").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	past := time.Now().Add(-24 * time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name   string
+		header []string
+		want   int
+	}{
+		{"matching If-Match", []string{"If-Match", etag}, http.StatusOK},
+		{"any If-Match", []string{"If-Match", "*"}, http.StatusOK},
+		{"stale If-Match", []string{"If-Match", `"other"`}, http.StatusPreconditionFailed},
+		{"If-Unmodified-Since before the entry", []string{"If-Unmodified-Since", past}, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(t, c, http.MethodGet, "/a", tt.header...); w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestDifferentlyEncodedPathsCoalesce(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	c := New(WithDefaultTTL(time.Minute))
+	if err := c.Register("/:name", func(p []string) ([]byte, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return []byte(p[0]), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"/a%20b", "/a b", "/%61%20b", "/a%20b"}
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		path := path
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.URL.Path, _ = url.PathUnescape(path)
+			r.URL.RawPath = path
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, r)
+			if got := body(t, w); got != "a b" {
+				t.Errorf("GET %s = %q, want a b", path, got)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("handler called %d times, want once", calls)
+	}
+}
+
+func TestSetCookieReplayedOnHit(t *testing.T) {
+	calls := 0
+	c := New(WithDefaultTTL(time.Minute))
+	if err := c.RegisterResponse("/a", func(context.Context, []string) (*Response, error) {
+		calls++
+		h := http.Header{}
+		h.Add("Set-Cookie", "a=1")
+		h.Add("Set-Cookie", "b=2")
+		return &Response{Body: []byte("a"), Header: h}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"miss", "hit"} {
+		w := serve(t, c, http.MethodGet, "/a")
+		got := w.Result().Header.Values("Set-Cookie")
+		if len(got) != 2 || got[0] != "a=1" || got[1] != "b=2" {
+			t.Errorf("%s: Set-Cookie = %q, want both cookies", name, got)
+		}
+		if calls != 1 {
+			t.Errorf("%s: handler called %d times after %d requests", name, calls, i+1)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	allow := func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer ok" }
+	tests := []struct {
+		name          string
+		challenge     string
+		authorization string
+		wantStatus    int
+		wantChallenge string
+		wantCalls     int
+	}{
+		{"allowed", `Bearer realm="api"`, "Bearer ok", http.StatusOK, "", 1},
+		{"challenged", `Bearer realm="api"`, "Bearer bad", http.StatusUnauthorized, `Bearer realm="api"`, 0},
+		{"no challenge", "", "", http.StatusForbidden, "", 0},
+		{"no challenge allowed", "", "Bearer ok", http.StatusOK, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := New(WithDefaultTTL(time.Hour))
+			err := c.Register("/a", func([]string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				return []byte("secret"), nil
+			}, WithAuth(allow, tt.challenge))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, "/a", "Authorization", tt.authorization)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.wantChallenge)
+			}
+			if tt.wantStatus != http.StatusOK && strings.Contains(body(t, w), "secret") {
+				t.Error("refused request was served the cached body")
+			}
+			if got := atomic.LoadInt32(&calls); int(got) != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", got, tt.wantCalls)
+			}
+			c.RLock()
+			cached := len(c.cache)
+			c.RUnlock()
+			if cached != tt.wantCalls {
+				t.Errorf("%d entries cached, want %d", cached, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRouteSpecificity(t *testing.T) {
+	c := New(WithDefaultTTL(time.Hour))
+	for _, pattern := range []string{"/files/*", "/files/images/*", "/files/:kind/thumb", "/docs/:id", "/:any/static"} {
+		pattern := pattern
+		err := c.RegisterResponse(pattern, func(ctx context.Context, _ []string) (*Response, error) {
+			params := ParamsFromContext(ctx)
+			return &Response{Body: []byte(pattern + " " + params["kind"] + params["id"] + params["any"])}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/files/images/x", "/files/images/* "},
+		{"/files/images/thumb", "/files/images/* "},
+		{"/files/docs/thumb", "/files/:kind/thumb docs"},
+		{"/files/docs/x", "/files/* "},
+		{"/files/docs/x/y", "/files/* "},
+		// The longer static prefix wins over a deeper static segment.
+		{"/docs/static", "/docs/:id static"},
+		{"/files/static", "/files/* "},
+		{"/other/static", "/:any/static other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			// Every request is answered by the same route each time.
+			for i := 0; i < 3; i++ {
+				if got := body(t, serve(t, c, http.MethodGet, tt.path)); got != tt.want {
+					t.Fatalf("GET %s = %q, want %q", tt.path, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// settled waits for the fill and any renewal of the entry for key to finish.
+func settled(t *testing.T, c *cache, key string) {
+	t.Helper()
+	c.RLock()
+	entry := c.cache[key]
+	c.RUnlock()
+	if entry == nil {
+		t.Fatalf("no entry for %s", key)
+	}
+	timeout := time.After(5 * time.Second)
+	select {
+	case <-entry.ready:
+	case <-timeout:
+		t.Fatalf("entry for %s was never populated", key)
+	}
+	entry.RLock()
+	renewed := entry.renewed
+	entry.RUnlock()
+	if renewed == nil {
+		return
+	}
+	select {
+	case <-renewed:
+	case <-timeout:
+		t.Fatalf("entry for %s was never renewed", key)
+	}
+}
+
+// versioned returns a handler answering with how often it was called, and
+// the count.
+func versioned() (HandlerFunc, *int32) {
+	var calls int32
+	return func([]string) ([]byte, error) {
+		return []byte(strconv.Itoa(int(atomic.AddInt32(&calls, 1)))), nil
+	}, &calls
+}
+
+func TestSyncRevalidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []RouteOptionFunc
+		want    string
+	}{
+		{"stale while revalidate", nil, "1"},
+		{"synchronous revalidation", []RouteOptionFunc{WithSyncRevalidation()}, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			clock := func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+			c := New(WithDefaultTTL(time.Minute), WithClock(clock))
+			handler, _ := versioned()
+			if err := c.Register("/a", handler, tt.options...); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			mu.Lock()
+			now = now.Add(2 * time.Minute)
+			mu.Unlock()
+			if got := body(t, serve(t, c, http.MethodGet, "/a")); got != tt.want {
+				t.Errorf("stale read = %q, want %q", got, tt.want)
+			}
+			settled(t, c, "/a")
+			if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "2" {
+				t.Errorf("read after renewal = %q, want 2", got)
+			}
+		})
+	}
+}
+
+func TestDynamicBranches(t *testing.T) {
+	c := New(WithDefaultTTL(time.Hour))
+	for _, pattern := range []string{"/x/:a", "/x/:b/y"} {
+		pattern := pattern
+		err := c.RegisterResponse(pattern, func(ctx context.Context, _ []string) (*Response, error) {
+			params := ParamsFromContext(ctx)
+			return &Response{Body: []byte(pattern + " a=" + params["a"] + " b=" + params["b"])}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/x/1", "/x/:a a=1 b="},
+		{"/x/1/y", "/x/:b/y a= b=1"},
+		{"/x/2/y", "/x/:b/y a= b=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := body(t, serve(t, c, http.MethodGet, tt.path)); got != tt.want {
+				t.Errorf("GET %s = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+	if err := c.Register("/x/:c", constant("c")); !errors.Is(err, ErrConflictingRoute) {
+		t.Errorf("registering /x/:c over /x/:a = %v, want ErrConflictingRoute", err)
+	}
+}
+
+func TestColdFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   []OptionFunc
+		block     bool
+		wantFirst string
+	}{
+		{"served while filling", nil, true, "fallback"},
+		{"without background renewal", []OptionFunc{WithoutBackgroundRenewal()}, false, "real"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			if !tt.block {
+				close(release)
+			}
+			var calls int32
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			err := c.Register("/a", func([]string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte("real"), nil
+			}, WithColdFallback([]byte("fallback")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, "/a")
+			if got := body(t, w); w.Code != http.StatusOK || got != tt.wantFirst {
+				t.Errorf("first GET = %d %q, want %q", w.Code, got, tt.wantFirst)
+			}
+			if tt.block {
+				close(release)
+			}
+			settled(t, c, "/a")
+			if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "real" {
+				t.Errorf("GET once populated = %q, want real", got)
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("handler called %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestFillWaitTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    []RouteOptionFunc
+		wantStatus int
+		wantBody   string
+	}{
+		{"unavailable", nil, http.StatusServiceUnavailable, ""},
+		{"cold fallback", []RouteOptionFunc{WithColdFallback([]byte("fallback"))}, http.StatusOK, "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var calls int32
+			c := New(WithFillWaitTimeout(20*time.Millisecond), WithDefaultTTL(time.Hour))
+			err := c.Register("/a", func([]string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte("real"), nil
+			}, tt.options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			w := serve(t, c, http.MethodGet, "/a")
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("slow fill held the request for %v", elapsed)
+			}
+			if w.Code != tt.wantStatus || tt.wantBody != "" && body(t, w) != tt.wantBody {
+				t.Errorf("GET during fill = %d %q, want %d %q", w.Code, body(t, w), tt.wantStatus, tt.wantBody)
+			}
+			close(release)
+			settled(t, c, "/a")
+			if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "real" {
+				t.Errorf("GET once populated = %q, want real", got)
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("handler called %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestCanceledWaiterReturnsEarly(t *testing.T) {
+	tests := []struct {
+		name         string
+		waiters      int
+		canceled     int
+		cancelFiller bool
+		stream       bool
+	}{
+		{"one of three", 3, 1, false, false},
+		{"all of two", 2, 2, false, false},
+		{"the filler", 2, 0, true, false},
+		{"the filler of a stream", 2, 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, release := make(chan struct{}), make(chan struct{})
+			var calls int32
+			c := New(WithDefaultTTL(time.Hour))
+			err := c.RegisterResponse("/a", func(ctx context.Context, _ []string) (*Response, error) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					close(started)
+				}
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				if tt.stream {
+					return &Response{Stream: io.NopCloser(strings.NewReader("v"))}, nil
+				}
+				return &Response{Body: []byte("v")}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			get := func(ctx context.Context) <-chan string {
+				got := make(chan string, 1)
+				go func() {
+					req := httptest.NewRequest(http.MethodGet, "/a", nil).WithContext(ctx)
+					w := httptest.NewRecorder()
+					c.ServeHTTP(w, req)
+					got <- w.Body.String()
+				}()
+				return got
+			}
+			fillerCtx, cancelFiller := context.WithCancel(context.Background())
+			defer cancelFiller()
+			filler := get(fillerCtx)
+			<-started
+			var waiting, canceled []<-chan string
+			for i := 0; i < tt.waiters; i++ {
+				if i < tt.canceled {
+					ctx, cancel := context.WithCancel(context.Background())
+					canceled = append(canceled, get(ctx))
+					cancel()
+				} else {
+					waiting = append(waiting, get(context.Background()))
+				}
+			}
+			if tt.cancelFiller {
+				cancelFiller()
+				canceled = append(canceled, filler)
+			} else {
+				waiting = append(waiting, filler)
+			}
+			for _, got := range canceled {
+				select {
+				case b := <-got:
+					if b == "v" {
+						t.Error("canceled request was served the value")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("canceled request kept waiting for the fill")
+				}
+			}
+			close(release)
+			for _, got := range waiting {
+				if b := <-got; b != "v" {
+					t.Errorf("waiter got %q, want v", b)
+				}
+			}
+			settled(t, c, "/a")
+			if b := body(t, serve(t, c, http.MethodGet, "/a")); b != "v" {
+				t.Errorf("GET after the fill = %q, want v", b)
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("handler called %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestSoftPurge(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    []OptionFunc
+		wait       time.Duration
+		slow       bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"slow renewal serves the purged value", []OptionFunc{WithSoftPurge()}, 20 * time.Millisecond, true, http.StatusOK, "1"},
+		{"fast renewal is waited for", []OptionFunc{WithSoftPurge()}, 5 * time.Second, false, http.StatusOK, "2"},
+		{"hard purge has nothing to serve", nil, 20 * time.Millisecond, true, http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var calls int32
+			c := New(append(tt.options, WithFillWaitTimeout(tt.wait), WithDefaultTTL(time.Hour))...)
+			err := c.Register("/a", func([]string) ([]byte, error) {
+				n := atomic.AddInt32(&calls, 1)
+				if n > 1 && tt.slow {
+					<-release
+				}
+				return []byte(strconv.Itoa(int(n))), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			if err := c.Purge("/a"); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, "/a")
+			if w.Code != tt.wantStatus || tt.wantBody != "" && body(t, w) != tt.wantBody {
+				t.Errorf("GET after purge = %d %q, want %d %q", w.Code, body(t, w), tt.wantStatus, tt.wantBody)
+			}
+			close(release)
+			settled(t, c, "/a")
+			if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "2" {
+				t.Errorf("GET once renewed = %q, want 2", got)
+			}
+		})
+	}
+}
+
+func TestPurgeKeys(t *testing.T) {
+	const (
+		segments = "/1?route=%2Fx%2F%3Aid%2F%3Arest"
+		json     = "/v/2?accept=application%2Fjson"
+		xml      = "/v/2?accept=application%2Fxml"
+	)
+	tests := []struct {
+		path   string
+		purged []string
+	}{
+		{"/x/1/a", []string{segments}},
+		{"/x/1/other", []string{segments}},
+		{"/1", []string{"/1"}},
+		{"/k/7", []string{"user:7"}},
+		{"/v/2", []string{json, xml}},
+		{"/none", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			c := New(WithDefaultTTL(time.Hour))
+			routes := map[string][]RouteOptionFunc{
+				"/x/:id/:rest": {WithKeySegments(1)},
+				"/:id":         nil,
+				"/k/:id": {WithRouteKeyFunc(func(_ *http.Request, p []string) string {
+					return "user:" + p[1]
+				})},
+				"/v/:id": {WithAcceptVariants("application/json", "application/xml")},
+			}
+			for pattern, options := range routes {
+				if err := c.Register(pattern, constant(pattern), options...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, r := range [][2]string{{"/x/1/a", ""}, {"/1", ""}, {"/k/7", ""}, {"/v/2", "application/json"}, {"/v/2", "application/xml"}} {
+				serve(t, c, http.MethodGet, r[0], "Accept", r[1])
+			}
+			if err := c.Purge(tt.path); err != nil {
+				t.Fatal(err)
+			}
+			purged := make(map[string]bool)
+			for _, key := range tt.purged {
+				purged[key] = true
+			}
+			c.RLock()
+			defer c.RUnlock()
+			for _, key := range []string{segments, "/1", "user:7", json, xml} {
+				if _, ok := c.cache[key]; ok == purged[key] {
+					t.Errorf("%s cached = %v after purging %s", key, ok, tt.path)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"no content", http.StatusNoContent, false},
+		{"teapot", http.StatusTeapot, false},
+		{"ok", http.StatusOK, false},
+		{"last server error", 599, false},
+		{"early hints", http.StatusEarlyHints, true},
+		{"continue", http.StatusContinue, true},
+		{"too low", 99, true},
+		{"too high", 600, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			err := c.RegisterStatus("/ping", tt.status)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RegisterStatus(%d) = %v, want error %v", tt.status, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for _, attempt := range []string{"miss", "hit"} {
+				w := serve(t, c, http.MethodGet, "/ping")
+				if w.Code != tt.status {
+					t.Errorf("%s: status = %d, want %d", attempt, w.Code, tt.status)
+				}
+				if w.Body.Len() != 0 {
+					t.Errorf("%s: body = %q, want none", attempt, w.Body.String())
+				}
+				if got := w.Header().Get("Content-Type"); got != "" {
+					t.Errorf("%s: Content-Type = %q on an empty body", attempt, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		header  http.Header
+		want    string
+	}{
+		{"built in", nil, nil, "application/json"},
+		{"configured", []OptionFunc{WithDefaultContentType("text/plain; charset=utf-8")}, nil, "text/plain; charset=utf-8"},
+		{"set by the handler", []OptionFunc{WithDefaultContentType("text/plain; charset=utf-8")}, http.Header{"Content-Type": {"text/csv"}}, "text/csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			if err := c.RegisterResponse("/a", func(context.Context, []string) (*Response, error) {
+				return &Response{Body: []byte("a"), Header: tt.header}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for _, attempt := range []string{"miss", "hit"} {
+				if got := serve(t, c, http.MethodGet, "/a").Header().Get("Content-Type"); got != tt.want {
+					t.Errorf("%s: Content-Type = %q, want %q", attempt, got, tt.want)
+				}
+			}
+		})
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("New accepted an empty default content type")
+			}
+		}()
+		New(WithDefaultContentType(""))
+	}()
+}
+
+func TestClear(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   []OptionFunc
+		partition []RouteOptionFunc
+	}{
+		{"unbounded", nil, nil},
+		{"bounded", []OptionFunc{WithMaxEntries(10), WithPartitionLimit("p", 10, 1<<10)}, []RouteOptionFunc{WithPartition("p")}},
+	}
+	paths := []string{"/a", "/b", "/p/c"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			if err := c.Register("/:id", constant("v")); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Register("/p/:id", constant("v"), tt.partition...); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range paths {
+				serve(t, c, http.MethodGet, path)
+			}
+			if got := c.Stats(); got.Entries != len(paths) || got.Misses != uint64(len(paths)) {
+				t.Fatalf("stats before Clear = %+v", got)
+			}
+			c.Clear()
+			if got := c.Stats().Entries; got != 0 {
+				t.Errorf("%d entries after Clear", got)
+			}
+			c.RLock()
+			for _, p := range []*partition{c.defaultPartition, c.partitions["p"]} {
+				if p != nil && (len(p.sizes) != 0 || p.bytes != 0) {
+					t.Errorf("partition still accounts for %d entries of %d bytes", len(p.sizes), p.bytes)
+				}
+			}
+			c.RUnlock()
+			for _, path := range paths {
+				if w := serve(t, c, http.MethodGet, path); w.Code != http.StatusOK {
+					t.Errorf("GET %s after Clear = %d, the route is gone", path, w.Code)
+				}
+			}
+			if got := c.Stats(); got.Misses != uint64(2*len(paths)) || got.Hits != 0 {
+				t.Errorf("requests after Clear were not misses: %+v", got)
+			}
+		})
+	}
+}
+
+func TestAgeHeader(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	c := New(WithDefaultTTL(time.Hour), WithClock(clock))
+	if err := c.Register("/a", constant("a")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		advance time.Duration
+		want    string
+	}{
+		{0, "0"},
+		{500 * time.Millisecond, "0"},
+		{5 * time.Second, "5"},
+		{time.Minute, "65"},
+		{30 * time.Minute, "1865"},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		now = now.Add(tt.advance)
+		mu.Unlock()
+		if got := serve(t, c, http.MethodGet, "/a").Header().Get("Age"); got != tt.want {
+			t.Errorf("Age after another %v = %q, want %q", tt.advance, got, tt.want)
+		}
+	}
+}
+
+func TestRouteConstraints(t *testing.T) {
+	var calls int32
+	c := New(WithDefaultTTL(time.Hour))
+	routes := map[string]string{
+		`/users/:id(\d+)`:     "user",
+		`/items/:id(\d+)`:     "item",
+		`/items/:slug`:        "slug",
+		`/files/:name(a|b)/x`: "file",
+	}
+	for pattern, name := range routes {
+		name := name
+		if err := c.RegisterResponse(pattern, func(ctx context.Context, _ []string) (*Response, error) {
+			atomic.AddInt32(&calls, 1)
+			params := ParamsFromContext(ctx)
+			return &Response{Body: []byte(name + " " + params["id"] + params["slug"] + params["name"])}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/users/42", http.StatusOK, "user 42"},
+		{"/users/0", http.StatusOK, "user 0"},
+		{"/users/abc", http.StatusNotFound, ""},
+		{"/users/42a", http.StatusNotFound, ""},
+		{"/users/a42", http.StatusNotFound, ""},
+		{"/items/7", http.StatusOK, "item 7"},
+		{"/items/seven", http.StatusOK, "slug seven"},
+		{"/files/a/x", http.StatusOK, "file a"},
+		{"/files/ab/x", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			before := atomic.LoadInt32(&calls)
+			w := serve(t, c, http.MethodGet, tt.path)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if atomic.LoadInt32(&calls) != before {
+					t.Error("a handler was called for a non-matching segment")
+				}
+				return
+			}
+			if got := body(t, w); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+	for _, pattern := range []string{`/bad/:id(\d+`, `/bad/:id([)`} {
+		if err := c.Register(pattern, constant("x")); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Register(%q) = %v, want ErrInvalidPath", pattern, err)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		incoming string
+	}{
+		{"echoed", "X-Request-ID", "abc-123"},
+		{"generated", "X-Request-ID", ""},
+		{"custom header", "x-correlation-id", "corr-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen []string
+			c := New(WithRequestID(tt.header), WithDefaultTTL(time.Hour))
+			if err := c.RegisterContext("/a", func(ctx context.Context, _ []string) ([]byte, error) {
+				seen = append(seen, RequestIDFromContext(ctx))
+				return []byte("a"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for i := 0; i < 2; i++ {
+				w := serve(t, c, http.MethodGet, "/a", tt.header, tt.incoming)
+				ids = append(ids, w.Header().Get(tt.header))
+			}
+			if len(seen) != 1 || seen[0] != ids[0] {
+				t.Errorf("handler saw request IDs %q, want the first response's %q", seen, ids[0])
+			}
+			for _, id := range ids {
+				if tt.incoming != "" && id != tt.incoming {
+					t.Errorf("%s = %q, want the incoming %q echoed", tt.header, id, tt.incoming)
+				}
+				if id == "" {
+					t.Errorf("no %s in the response", tt.header)
+				}
+			}
+			if tt.incoming == "" && ids[0] == ids[1] {
+				t.Errorf("both requests got the generated ID %q", ids[0])
+			}
+		})
+	}
+}
+
+func TestFoldDynamicCase(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		paths   []string
+		keys    []string
+	}{
+		{"folded", []OptionFunc{WithFoldDynamicCase()}, []string{"/Users/Alice", "/Users/alice", "/Users/ALICE"}, []string{"/Users/alice"}},
+		{"not folded", nil, []string{"/Users/Alice", "/Users/alice"}, []string{"/Users/Alice", "/Users/alice"}},
+		{"caught segments", []OptionFunc{WithFoldDynamicCase()}, []string{"/Files/A/B", "/Files/a/b"}, []string{"/Files/a/b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			handler := func(p []string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				return []byte(strings.Join(p, "/")), nil
+			}
+			if err := c.Register("/Users/:name", handler); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Register("/Files/*", handler); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range tt.paths {
+				if w := serve(t, c, http.MethodGet, path); w.Code != http.StatusOK {
+					t.Errorf("GET %s = %d", path, w.Code)
+				}
+			}
+			if w := serve(t, c, http.MethodGet, "/users/alice"); w.Code != http.StatusNotFound {
+				t.Errorf("GET /users/alice = %d, want static segments to keep their case", w.Code)
+			}
+			c.RLock()
+			defer c.RUnlock()
+			if len(c.cache) != len(tt.keys) || int(atomic.LoadInt32(&calls)) != len(tt.keys) {
+				t.Errorf("%d entries from %d calls, want %d", len(c.cache), calls, len(tt.keys))
+			}
+			for _, key := range tt.keys {
+				if _, ok := c.cache[key]; !ok {
+					t.Errorf("no entry for %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	c := New(WithDefaultTTL(time.Hour))
+	if err := c.Register("/doc", constant("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(t, c, http.MethodGet, "/doc")
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("ETag %q, Last-Modified %q", etag, modified)
+	}
+	past := time.Now().Add(-24 * time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name    string
+		ifRange string
+		code    int
+		body    string
+	}{
+		{"no If-Range", "", http.StatusPartialContent, "0123"},
+		{"matching ETag", etag, http.StatusPartialContent, "0123"},
+		{"stale ETag", `"other"`, http.StatusOK, "0123456789"},
+		{"matching Last-Modified", modified, http.StatusPartialContent, "0123"},
+		{"stale Last-Modified", past, http.StatusOK, "0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := []string{"Range", "bytes=0-3"}
+			if tt.ifRange != "" {
+				header = append(header, "If-Range", tt.ifRange)
+			}
+			w := serve(t, c, http.MethodGet, "/doc", header...)
+			if w.Code != tt.code || w.Body.String() != tt.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.code, tt.body)
+			}
+		})
+	}
+}
+
+func TestRecursionLoops(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		path    string
+		next    func(p []string) string
+		calls   int
+	}{
+		{"depth limit", []OptionFunc{WithMaxRecursionDepth(3)}, "/hop/1", func(p []string) string {
+			n, _ := strconv.Atoi(p[1])
+			return "/hop/" + strconv.Itoa(n+1)
+		}, 3},
+		{"same key", nil, "/hop/1", func(p []string) string { return "/hop/" + p[1] }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var codes []int
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			if err := c.RegisterResponse("/hop/:n", func(ctx context.Context, p []string) (*Response, error) {
+				r := httptest.NewRequest(http.MethodGet, tt.next(p), nil).WithContext(ctx)
+				w := httptest.NewRecorder()
+				c.ServeHTTP(w, r)
+				mu.Lock()
+				codes = append(codes, w.Code)
+				mu.Unlock()
+				return &Response{Body: []byte(strconv.Itoa(w.Code))}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, tt.path)
+			if w.Code != http.StatusOK {
+				t.Fatalf("outer request got %d", w.Code)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(codes) != tt.calls || codes[0] != http.StatusLoopDetected {
+				t.Errorf("inner requests got %v, want %d calls ending in %d", codes, tt.calls, http.StatusLoopDetected)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []RouteOptionFunc
+		stale   bool
+	}{
+		{"background fill", []RouteOptionFunc{WithColdFallback([]byte("fallback"))}, false},
+		{"background renewal", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseline := runtime.NumGoroutine()
+			var offset atomic.Int64
+			start := time.Now()
+			c := New(WithDefaultTTL(time.Minute), WithClock(func() time.Time {
+				return start.Add(time.Duration(offset.Load()))
+			}))
+			started := make(chan struct{}, 2)
+			var calls int32
+			if err := c.RegisterContext("/a", func(ctx context.Context, _ []string) ([]byte, error) {
+				if atomic.AddInt32(&calls, 1) == 1 && tt.stale {
+					return []byte("a"), nil
+				}
+				started <- struct{}{}
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}, tt.options...); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			if tt.stale {
+				offset.Store(int64(time.Hour))
+				serve(t, c, http.MethodGet, "/a")
+			}
+			<-started
+			if err := c.Close(); err != nil {
+				t.Fatalf("Close() = %v", err)
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > baseline {
+				t.Errorf("%d goroutines after Close, want at most %d", n, baseline)
+			}
+			if err := c.Close(); err != nil {
+				t.Errorf("second Close() = %v", err)
+			}
+		})
+	}
+}
+
+func TestRegisterRenewal(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+	}{
+		{"background", nil},
+		{"synchronous", []OptionFunc{WithoutBackgroundRenewal()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offset atomic.Int64
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			now := func() time.Time { return start.Add(time.Duration(offset.Load())) }
+			c := New(append(tt.options, WithDefaultTTL(time.Minute), WithClock(now))...)
+			var mu sync.Mutex
+			var expiries []time.Time
+			if err := c.RegisterRenewal("/events", func(_ context.Context, _ []string, prev []byte, prevExpiry time.Time) ([]byte, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				expiries = append(expiries, prevExpiry)
+				return append(append([]byte(nil), prev...), 'e'+byte(len(expiries)-1)), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range []string{"e", "ef", "efg"} {
+				offset.Store(int64(time.Duration(i) * time.Hour))
+				serve(t, c, http.MethodGet, "/events")
+				settled(t, c, "/events")
+				if got := body(t, serve(t, c, http.MethodGet, "/events")); got != want {
+					t.Errorf("value after %d renewals = %q, want %q", i, got, want)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			wantExpiries := []time.Time{{}, start.Add(time.Minute), start.Add(time.Hour + time.Minute)}
+			for i, want := range wantExpiries {
+				if i >= len(expiries) || !expiries[i].Equal(want) {
+					t.Errorf("previous expiries = %v, want %v", expiries, wantExpiries)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyAndNilValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  []byte
+		err    error
+		code   int
+		body   string
+		cached bool
+	}{
+		{"empty", []byte{}, nil, http.StatusOK, "", true},
+		{"nil", nil, nil, http.StatusNotFound, ErrNotFound.Error(), false},
+		{"not found", []byte("x"), ErrNotFound, http.StatusNotFound, ErrNotFound.Error(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := New(WithDefaultTTL(time.Hour))
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				return tt.value, tt.err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				w := serve(t, c, http.MethodGet, "/a")
+				if got := body(t, w); w.Code != tt.code || got != tt.body {
+					t.Errorf("GET = %d %q, want %d %q", w.Code, got, tt.code, tt.body)
+				}
+			}
+			want := int32(2)
+			if tt.cached {
+				want = 1
+			}
+			if n := atomic.LoadInt32(&calls); n != want {
+				t.Errorf("handler called %d times, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestClientCacheControl(t *testing.T) {
+	t.Run("empty directive", func(t *testing.T) {
+		if err := WithClientCacheControl("")(&cache{}); err == nil {
+			t.Error("WithClientCacheControl(\"\") succeeded")
+		}
+	})
+	var mu sync.Mutex
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	c := New(WithDefaultTTL(time.Minute), WithClock(clock), WithClientCacheControl("public"), WithoutBackgroundRenewal())
+	if err := c.Register("/a", constant("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterResponse("/private", func(context.Context, []string) (*Response, error) {
+		return &Response{Body: []byte("p"), NoStore: true}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		advance time.Duration
+		want    string
+	}{
+		{0, "public, max-age=60"},
+		{10 * time.Second, "public, max-age=50"},
+		{49 * time.Second, "public, max-age=1"},
+		// Stale by now, so renewed for another minute.
+		{1500 * time.Millisecond, "public, max-age=60"},
+		{30 * time.Second, "public, max-age=30"},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		now = now.Add(tt.advance)
+		mu.Unlock()
+		if got := serve(t, c, http.MethodGet, "/a").Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("Cache-Control after another %v = %q, want %q", tt.advance, got, tt.want)
+		}
+	}
+	if got := serve(t, c, http.MethodGet, "/private").Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control of an uncached response = %q, want no-store", got)
+	}
+}
+
+func TestVaryCookie(t *testing.T) {
+	var calls int32
+	c := New(WithDefaultTTL(time.Hour))
+	if err := c.Register("/page", func([]string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte("page"), nil
+	}, WithVaryCookie("theme")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		cookie string
+		key    string
+	}{
+		{"dark", "theme=dark", "/page?cookie=dark"},
+		{"light", "theme=light", "/page?cookie=light"},
+		{"other cookies only", "session=1", "/page"},
+		{"no cookie", "", "/page"},
+		{"dark again", "session=2; theme=dark", "/page?cookie=dark"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header []string
+			if tt.cookie != "" {
+				header = []string{"Cookie", tt.cookie}
+			}
+			w := serve(t, c, http.MethodGet, "/page", header...)
+			if got := w.Header().Get("Vary"); got != "Cookie" {
+				t.Errorf("Vary = %q, want Cookie", got)
+			}
+			c.RLock()
+			_, ok := c.cache[tt.key]
+			c.RUnlock()
+			if !ok {
+				t.Errorf("no entry for %s", tt.key)
+			}
+		})
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if n := atomic.LoadInt32(&calls); len(c.cache) != 3 || n != 3 {
+		t.Errorf("%d entries from %d calls, want 3 of each", len(c.cache), n)
+	}
+}
+
+func TestStrictSlashes(t *testing.T) {
+	tests := []struct {
+		path   string
+		strict int
+		loose  int
+	}{
+		{"/a/b", http.StatusOK, http.StatusOK},
+		{"/a//b", http.StatusBadRequest, http.StatusOK},
+		{"//a/b", http.StatusBadRequest, http.StatusOK},
+		{"/a/b//", http.StatusBadRequest, http.StatusOK},
+	}
+	strict := New(WithDefaultTTL(time.Hour), WithStrictSlashes())
+	loose := New(WithDefaultTTL(time.Hour))
+	for _, c := range []*cache{strict, loose} {
+		if err := c.Register("/a/b", constant("ab")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if w := serve(t, strict, http.MethodGet, tt.path); w.Code != tt.strict {
+				t.Errorf("strict GET %s = %d, want %d", tt.path, w.Code, tt.strict)
+			}
+			w := serve(t, loose, http.MethodGet, tt.path)
+			if got := body(t, w); w.Code != tt.loose || got != "ab" {
+				t.Errorf("collapsing GET %s = %d %q, want %d \"ab\"", tt.path, w.Code, got, tt.loose)
+			}
+		})
+	}
+	loose.RLock()
+	defer loose.RUnlock()
+	if len(loose.cache) != 1 {
+		t.Errorf("collapsed paths made %d entries, want 1", len(loose.cache))
+	}
+}
+
+func TestMaxRenewalGoroutines(t *testing.T) {
+	const n, keys = 3, 20
+	var offset atomic.Int64
+	start := time.Now()
+	c := New(WithDefaultTTL(time.Minute), WithMaxRenewalGoroutines(n), WithClock(func() time.Time {
+		return start.Add(time.Duration(offset.Load()))
+	}))
+	var mu sync.Mutex
+	running, peak, renewals := 0, 0, 0
+	filled := make(map[string]bool)
+	release := make(chan struct{})
+	if err := c.Register("/k/:id", func(p []string) ([]byte, error) {
+		mu.Lock()
+		if !filled[p[1]] {
+			filled[p[1]] = true
+			mu.Unlock()
+			return []byte("v1"), nil
+		}
+		renewals++
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return []byte("v2"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	path := func(i int) string { return "/k/" + strconv.Itoa(i) }
+	for i := 0; i < keys; i++ {
+		serve(t, c, http.MethodGet, path(i))
+	}
+	offset.Store(int64(time.Hour))
+	for i := 0; i < keys; i++ {
+		if got := body(t, serve(t, c, http.MethodGet, path(i))); got != "v1" {
+			t.Errorf("GET %s = %q, want the stale value", path(i), got)
+		}
+	}
+	if got := len(c.InFlightRenewals()); got > n {
+		t.Errorf("%d renewals in flight, want at most %d", got, n)
+	}
+	close(release)
+	// Stale entries passed over before are renewed as slots free up.
+	for round := 0; round < keys; round++ {
+		for i := 0; i < keys; i++ {
+			serve(t, c, http.MethodGet, path(i))
+			settled(t, c, path(i))
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > n {
+		t.Errorf("%d renewals ran at once, want at most %d", peak, n)
+	}
+	if renewals != keys {
+		t.Errorf("%d renewals, want one per key", renewals)
+	}
+}
+
+func TestSlowHandlerThreshold(t *testing.T) {
+	tests := []struct {
+		name     string
+		fill     time.Duration
+		renewal  time.Duration
+		wantLogs int
+	}{
+		{"fast", 100 * time.Millisecond, 100 * time.Millisecond, 0},
+		{"slow fill", 2 * time.Second, 100 * time.Millisecond, 1},
+		{"slow renewal", 100 * time.Millisecond, 2 * time.Second, 1},
+		{"both slow", 2 * time.Second, 2 * time.Second, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var logs []string
+			l := funcr.New(func(prefix, args string) {
+				mu.Lock()
+				defer mu.Unlock()
+				logs = append(logs, args)
+			}, funcr.Options{})
+			var offset atomic.Int64
+			start := time.Now()
+			c := New(WithLogger(l), WithSlowHandlerThreshold(time.Second), WithDefaultTTL(time.Minute), WithoutBackgroundRenewal(), WithClock(func() time.Time {
+				return start.Add(time.Duration(offset.Load()))
+			}))
+			took := tt.fill
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				offset.Add(int64(took))
+				return []byte("a"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			took = tt.renewal
+			offset.Add(int64(time.Hour))
+			serve(t, c, http.MethodGet, "/a")
+			mu.Lock()
+			defer mu.Unlock()
+			var slow []string
+			for _, line := range logs {
+				if strings.Contains(line, `"msg"="slow handler"`) {
+					slow = append(slow, line)
+				}
+			}
+			if len(slow) != tt.wantLogs {
+				t.Fatalf("logged %d slow handlers, want %d: %q", len(slow), tt.wantLogs, slow)
+			}
+			for _, line := range slow {
+				if !strings.Contains(line, `"key"="/a"`) || !strings.Contains(line, `"duration"="2s"`) {
+					t.Errorf("slow handler logged as %s, want the key and duration", line)
+				}
+			}
+		})
+	}
+}
+
+func TestVaryHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		keys    []string
+	}{
+		{"shared", nil, []string{"/status"}},
+		{"per host", []OptionFunc{WithVaryHost()}, []string{"/status?host=a.example.com", "/status?host=b.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			if err := c.Register("/status", func([]string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				return []byte("ok"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for _, url := range []string{"http://a.example.com/status", "http://b.example.com/status", "http://A.example.com/status", "http://b.example.com/status"} {
+				if w := serve(t, c, http.MethodGet, url); w.Code != http.StatusOK {
+					t.Errorf("GET %s = %d", url, w.Code)
+				}
+			}
+			c.RLock()
+			defer c.RUnlock()
+			if n := int(atomic.LoadInt32(&calls)); len(c.cache) != len(tt.keys) || n != len(tt.keys) {
+				t.Errorf("%d entries from %d calls, want %d", len(c.cache), n, len(tt.keys))
+			}
+			for _, key := range tt.keys {
+				if _, ok := c.cache[key]; !ok {
+					t.Errorf("no entry for %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestPurgeFunc(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var offset atomic.Int64
+	now := func() time.Time { return start.Add(time.Duration(offset.Load())) }
+	ttls := map[string]time.Duration{"/a": time.Minute, "/b": time.Hour, "/c": 2 * time.Minute, "/marked": time.Hour}
+	tests := []struct {
+		name string
+		pred func(key string, value []byte, expiry time.Time) bool
+		kept []string
+	}{
+		{"expired", func(_ string, _ []byte, expiry time.Time) bool { return expiry.Before(now()) }, []string{"/b", "/marked"}},
+		{"by body", func(_ string, value []byte, _ time.Time) bool { return bytes.Contains(value, []byte("marker")) }, []string{"/a", "/b", "/c"}},
+		{"none", func(string, []byte, time.Time) bool { return false }, []string{"/a", "/b", "/c", "/marked"}},
+		{"all", func(string, []byte, time.Time) bool { return true }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var evicted []string
+			offset.Store(0)
+			c := New(WithClock(now), WithOnEvict(func(key string, _ []byte, reason EvictReason) {
+				if reason == EvictPurged {
+					evicted = append(evicted, key)
+				}
+			}))
+			for path, ttl := range ttls {
+				ttl, value := ttl, "v"
+				if path == "/marked" {
+					value = "has a marker"
+				}
+				if err := c.RegisterResponse(path, func(context.Context, []string) (*Response, error) {
+					return &Response{Body: []byte(value), TTL: ttl}, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				serve(t, c, http.MethodGet, path)
+			}
+			offset.Store(int64(5 * time.Minute))
+			c.PurgeFunc(tt.pred)
+			if got := strings.Join(c.Keys(), ","); got != strings.Join(tt.kept, ",") {
+				t.Errorf("kept %s, want %s", got, strings.Join(tt.kept, ","))
+			}
+			if len(evicted)+len(tt.kept) != len(ttls) {
+				t.Errorf("evicted %v as purged", evicted)
+			}
+		})
+	}
+}
+
+func TestRouteKeyFunc(t *testing.T) {
+	var calls int32
+	c := New(WithDefaultTTL(time.Hour))
+	handler := func(p []string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte(p[1]), nil
+	}
+	// Everything under a tenant shares one entry.
+	if err := c.Register("/tenants/:id/*", handler, WithRouteKeyFunc(func(_ *http.Request, path []string) string {
+		return "tenant:" + path[1]
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register("/fine/*", handler); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{"/tenants/acme/a", "tenant:acme"},
+		{"/tenants/acme/b/c", "tenant:acme"},
+		{"/tenants/acme/d?x=1", "tenant:acme"},
+		{"/tenants/other/a", "tenant:other"},
+		{"/fine/a", "/fine/a"},
+		{"/fine/b", "/fine/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if w := serve(t, c, http.MethodGet, tt.path); w.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d", tt.path, w.Code)
+			}
+			c.RLock()
+			defer c.RUnlock()
+			if _, ok := c.cache[tt.key]; !ok {
+				t.Errorf("no entry for %s", tt.key)
+			}
+		})
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if n := atomic.LoadInt32(&calls); len(c.cache) != 4 || n != 4 {
+		t.Errorf("%d entries from %d calls, want 4 of each", len(c.cache), n)
+	}
+}
+
+func TestRoutingErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		want  error
+		cause any
+	}{
+		{"bad encoding", "/a/%zz", ErrBadEncoding, new(url.EscapeError)},
+		{"repeated parameter", "/a/:id/:id", ErrInvalidPath, nil},
+		{"unterminated constraint", "/a/:id(\\d+", ErrInvalidPath, nil},
+		{"bad constraint", "/a/:id([)", ErrInvalidPath, new(*syntax.Error)},
+		{"conflicting parameter", "/x/:b", ErrConflictingRoute, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			if err := c.Register("/x/:a", constant("x")); err != nil {
+				t.Fatal(err)
+			}
+			err := c.Register(tt.path, constant("v"))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Register(%q) = %v, want %v", tt.path, err, tt.want)
+			}
+			for _, other := range []error{ErrBadEncoding, ErrInvalidPath, ErrConflictingRoute} {
+				if other != tt.want && errors.Is(err, other) {
+					t.Errorf("Register(%q) = %v, which is also %v", tt.path, err, other)
+				}
+			}
+			if tt.cause != nil && !errors.As(err, tt.cause) {
+				t.Errorf("Register(%q) = %v, want it to wrap a %T", tt.path, err, tt.cause)
+			}
+		})
+	}
+	t.Run("purge", func(t *testing.T) {
+		if err := New().Purge("/a/%zz"); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("Purge = %v, want ErrBadEncoding", err)
+		}
+	})
+}
+
+func TestBodyInKey(t *testing.T) {
+	var calls int32
+	c := New(WithDefaultTTL(time.Hour))
+	if err := c.RegisterContext("/compute", func(ctx context.Context, _ []string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return bytes.ToUpper(BodyFromContext(ctx)), nil
+	}, WithBodyInKey()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		body  string
+		code  int
+		want  string
+		calls int32
+	}{
+		{"first payload", `{"n":1}`, http.StatusOK, `{"N":1}`, 1},
+		{"identical payload", `{"n":1}`, http.StatusOK, `{"N":1}`, 1},
+		{"different payload", `{"n":2}`, http.StatusOK, `{"N":2}`, 2},
+		{"empty payload", "", http.StatusOK, "", 3},
+		{"first payload again", `{"n":1}`, http.StatusOK, `{"N":1}`, 3},
+		{"too large", strings.Repeat("x", maxKeyedBodySize+1), http.StatusRequestEntityTooLarge, "request body too large", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/compute", strings.NewReader(tt.body)))
+			if got := w.Body.String(); w.Code != tt.code || got != tt.want {
+				t.Errorf("POST = %d %q, want %d %q", w.Code, got, tt.code, tt.want)
+			}
+			if n := atomic.LoadInt32(&calls); n != tt.calls {
+				t.Errorf("handler called %d times, want %d", n, tt.calls)
+			}
+		})
+	}
+}
+
+func TestSyncHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted bool
+		header  string
+		sync    bool
+	}{
+		{"trusted", true, "true", true},
+		{"trusted, any case", true, "TRUE", true},
+		{"trusted, not set", true, "", false},
+		{"trusted, false", true, "false", false},
+		{"untrusted", false, "true", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offset atomic.Int64
+			start := time.Now()
+			c := New(WithTrustedHeaders(tt.trusted), WithDefaultTTL(time.Minute), WithClock(func() time.Time {
+				return start.Add(time.Duration(offset.Load()))
+			}))
+			var calls int32
+			release := make(chan struct{})
+			defer close(release)
+			synchronous := tt.sync
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				n := atomic.AddInt32(&calls, 1)
+				if n > 1 && !synchronous {
+					// A background renewal would never finish, so the
+					// request must not wait for it.
+					<-release
+				}
+				return []byte("v" + strconv.Itoa(int(n))), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			offset.Store(int64(time.Hour))
+			var header []string
+			if tt.header != "" {
+				header = []string{syncHeader, tt.header}
+			}
+			want := "v1"
+			if tt.sync {
+				want = "v2"
+			}
+			if got := body(t, serve(t, c, http.MethodGet, "/a", header...)); got != want {
+				t.Errorf("stale GET = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServeOnError(t *testing.T) {
+	errPartial := errors.New("partial results")
+	tests := []struct {
+		name    string
+		enabled bool
+		value   []byte
+		code    int
+		body    string
+	}{
+		{"value and error served", true, []byte("partial"), http.StatusOK, "partial"},
+		{"value and error failed", false, []byte("partial"), http.StatusInternalServerError, errPartial.Error()},
+		{"error alone served", true, nil, http.StatusInternalServerError, errPartial.Error()},
+		{"error alone failed", false, nil, http.StatusInternalServerError, errPartial.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := New(WithServeOnError(tt.enabled), WithDefaultTTL(time.Hour))
+			value := tt.value
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				return value, errPartial
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 2; i++ {
+				w := serve(t, c, http.MethodGet, "/a")
+				if got := body(t, w); w.Code != tt.code || got != tt.body {
+					t.Errorf("GET = %d %q, want %d %q", w.Code, got, tt.code, tt.body)
+				}
+				// Neither outcome is cached.
+				if n := atomic.LoadInt32(&calls); n != int32(i) {
+					t.Errorf("handler called %d times after %d requests", n, i)
+				}
+			}
+		})
+	}
+}
+
+func TestTTLFunc(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(WithDefaultTTL(10*time.Minute), WithClock(func() time.Time { return now }), WithTTLFunc(func(path []string, resp *Response) time.Duration {
+		if path[0] == "pinned" {
+			return 24 * time.Hour
+		}
+		if len(resp.Body) >= 100 {
+			return time.Hour
+		}
+		return 0
+	}))
+	bodies := map[string]string{"/small": "a", "/large": strings.Repeat("x", 100), "/pinned": "p"}
+	for path, b := range bodies {
+		if err := c.Register(path, constant(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.RegisterResponse("/explicit", func(context.Context, []string) (*Response, error) {
+		return &Response{Body: []byte(strings.Repeat("x", 100)), TTL: 5 * time.Minute}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want time.Duration
+	}{
+		{"/small", 10 * time.Minute},
+		{"/large", time.Hour},
+		{"/pinned", 24 * time.Hour},
+		{"/explicit", 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			serve(t, c, http.MethodGet, tt.path)
+			if got := expiry(t, c, tt.path, now); got != tt.want {
+				t.Errorf("TTL = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	t.Run("nil name func", func(t *testing.T) {
+		if err := WithContentDisposition(nil)(&route{}); err == nil {
+			t.Error("WithContentDisposition(nil) succeeded")
+		}
+	})
+	var calls int32
+	c := New(WithDefaultTTL(time.Hour))
+	name := WithContentDisposition(func(p []string) string {
+		if p[1] == "unnamed" {
+			return ""
+		}
+		return p[1] + ".csv"
+	})
+	if err := c.RegisterResponse("/reports/:id", func(_ context.Context, p []string) (*Response, error) {
+		atomic.AddInt32(&calls, 1)
+		resp := &Response{Body: []byte("a,b")}
+		if p[1] == "own" {
+			resp.Header = http.Header{"Content-Disposition": {"inline"}}
+		}
+		return resp, nil
+	}, name); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/reports/q1", `attachment; filename=q1.csv`},
+		{"/reports/q1", `attachment; filename=q1.csv`},
+		{"/reports/q2 2026", `attachment; filename="q2 2026.csv"`},
+		{"/reports/own", "inline"},
+		{"/reports/unnamed", ""},
+	}
+	for _, tt := range tests {
+		if got := serve(t, c, http.MethodGet, strings.ReplaceAll(tt.path, " ", "%20")).Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("GET %s: Content-Disposition = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("handler called %d times, want the header replayed on hits", n)
+	}
+}
+
+func TestMaxStaleAge(t *testing.T) {
+	errDown := errors.New("upstream down")
+	tests := []struct {
+		name  string
+		stale time.Duration
+		fail  bool
+		code  int
+		body  string
+	}{
+		{"within the limit", 5 * time.Minute, false, http.StatusOK, "v1"},
+		{"past the limit", 20 * time.Minute, false, http.StatusOK, "v2"},
+		{"past the limit, failing", 20 * time.Minute, true, http.StatusInternalServerError, errDown.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offset atomic.Int64
+			start := time.Now()
+			c := New(WithMaxStaleAge(10*time.Minute), WithDefaultTTL(time.Minute), WithClock(func() time.Time {
+				return start.Add(time.Duration(offset.Load()))
+			}))
+			var calls int32
+			release := make(chan struct{})
+			defer close(release)
+			fail, background := tt.fail, tt.stale < 10*time.Minute
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				n := atomic.AddInt32(&calls, 1)
+				if n == 1 {
+					return []byte("v1"), nil
+				}
+				if fail {
+					return nil, errDown
+				}
+				if background {
+					// The request must not wait for this renewal.
+					<-release
+				}
+				return []byte("v" + strconv.Itoa(int(n))), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			offset.Store(int64(time.Minute + tt.stale))
+			w := serve(t, c, http.MethodGet, "/a")
+			if got := body(t, w); w.Code != tt.code || got != tt.body {
+				t.Errorf("GET %v past expiry = %d %q, want %d %q", tt.stale, w.Code, got, tt.code, tt.body)
+			}
+		})
+	}
+	t.Run("non-positive", func(t *testing.T) {
+		if err := WithMaxStaleAge(0)(&cache{}); err == nil {
+			t.Error("WithMaxStaleAge(0) succeeded")
+		}
+	})
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   []RouteOptionFunc
+		body    string
+		chunked bool
+		code    int
+	}{
+		{"within the limit", nil, "0123456789", false, http.StatusOK},
+		{"over the limit", nil, "0123456789x", false, http.StatusRequestEntityTooLarge},
+		{"keyed within the limit", []RouteOptionFunc{WithBodyInKey()}, "0123456789", false, http.StatusOK},
+		{"keyed over the limit", []RouteOptionFunc{WithBodyInKey()}, "0123456789x", false, http.StatusRequestEntityTooLarge},
+		{"keyed without a length within the limit", []RouteOptionFunc{WithBodyInKey()}, "0123456789", true, http.StatusOK},
+		{"keyed without a length over the limit", []RouteOptionFunc{WithBodyInKey()}, "0123456789x", true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithDefaultTTL(time.Hour))
+			if err := c.Register("/upload", constant("ok"), append(tt.route, WithMaxRequestBody(10))...); err != nil {
+				t.Fatal(err)
+			}
+			var src io.Reader = strings.NewReader(tt.body)
+			if tt.chunked {
+				// Hide the length from httptest.NewRequest.
+				src = io.MultiReader(src)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/upload", src)
+			if want := int64(-1); tt.chunked && r.ContentLength != want {
+				t.Fatalf("ContentLength = %d, want %d", r.ContentLength, want)
+			}
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("POST %d bytes = %d %q, want %d", len(tt.body), w.Code, w.Body.String(), tt.code)
+			}
+		})
+	}
+	t.Run("non-positive", func(t *testing.T) {
+		if err := WithMaxRequestBody(0)(&route{}); err == nil {
+			t.Error("WithMaxRequestBody(0) succeeded")
+		}
+	})
+}
+
+func TestUnicodeNormalization(t *testing.T) {
+	nfc, nfd := norm.NFC.String("café"), norm.NFD.String("café")
+	if nfc == nfd {
+		t.Fatal("the normal forms of café are the same")
+	}
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		pattern string
+		entries int
+	}{
+		{"NFC, registered in NFC", []OptionFunc{WithUnicodeNormalization(norm.NFC)}, nfc, 1},
+		{"NFC, registered in NFD", []OptionFunc{WithUnicodeNormalization(norm.NFC)}, nfd, 1},
+		{"NFD", []OptionFunc{WithUnicodeNormalization(norm.NFD)}, nfc, 1},
+		{"not normalized", nil, "*", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			if err := c.Register("/menu/"+tt.pattern, func([]string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				return []byte("menu"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range []string{nfc, nfd, nfc, nfd} {
+				path := "/menu/" + url.PathEscape(s)
+				if w := serve(t, c, http.MethodGet, path); w.Code != http.StatusOK {
+					t.Errorf("GET %s = %d", path, w.Code)
+				}
+			}
+			c.RLock()
+			defer c.RUnlock()
+			if n := int(atomic.LoadInt32(&calls)); len(c.cache) != tt.entries || n != tt.entries {
+				t.Errorf("%d entries from %d calls, want %d", len(c.cache), n, tt.entries)
+			}
+		})
+	}
+}
+
+func TestPanickingRenewalKeepsValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+	}{
+		{"background", nil},
+		{"synchronous", []OptionFunc{WithoutBackgroundRenewal()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var logs []string
+			l := funcr.New(func(_, args string) {
+				mu.Lock()
+				defer mu.Unlock()
+				logs = append(logs, args)
+			}, funcr.Options{})
+			var offset atomic.Int64
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			now := func() time.Time { return start.Add(time.Duration(offset.Load())) }
+			c := New(append(tt.options, WithLogger(l), WithDefaultTTL(time.Minute), WithClock(now))...)
+			var calls int32
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				if atomic.AddInt32(&calls, 1) > 1 {
+					panic("boom")
+				}
+				return []byte("good"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			offset.Store(int64(time.Hour))
+			for i := 0; i < 2; i++ {
+				w := serve(t, c, http.MethodGet, "/a")
+				settled(t, c, "/a")
+				if got := body(t, w); w.Code != http.StatusOK || got != "good" {
+					t.Errorf("GET after a panicking renewal = %d %q, want the old value", w.Code, got)
+				}
+			}
+			if got := expiry(t, c, "/a", start); got != time.Minute {
+				t.Errorf("expiry moved by %v, want it untouched", got-time.Minute)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			logged := false
+			for _, line := range logs {
+				logged = logged || strings.Contains(line, "handler panicked: boom")
+			}
+			if !logged {
+				t.Errorf("panic not logged in %q", logs)
+			}
+		})
+	}
+}
+
+func TestRootRoute(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []OptionFunc
+		register bool
+		code     int
+		location string
+	}{
+		{"no handler", nil, false, http.StatusNotFound, ""},
+		{"handler", nil, true, http.StatusOK, ""},
+		{"redirect", []OptionFunc{WithRootRedirect("/docs")}, false, http.StatusFound, "/docs"},
+		{"redirect over a handler", []OptionFunc{WithRootRedirect("/docs")}, true, http.StatusFound, "/docs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(tt.options...)
+			if err := c.Register("/docs", constant("docs")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.register {
+				if err := c.Register("/", constant("root")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w := serve(t, c, http.MethodGet, "/")
+			if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+				t.Errorf("GET / = %d to %q, want %d to %q", w.Code, w.Header().Get("Location"), tt.code, tt.location)
+			}
+			if got := body(t, serve(t, c, http.MethodGet, "/docs")); got != "docs" {
+				t.Errorf("GET /docs = %q, want docs", got)
+			}
+		})
+	}
+	for _, path := range []string{"", "/"} {
+		if err := WithRootRedirect(path)(&cache{}); err == nil {
+			t.Errorf("WithRootRedirect(%q) succeeded", path)
+		}
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	sunset := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name        string
+		options     []RouteOptionFunc
+		deprecation string
+		sunset      string
+		logs        int
+	}{
+		{"not deprecated", nil, "", "", 0},
+		{"sunset", []RouteOptionFunc{WithDeprecation(sunset, "use /b")}, "true", "Wed, 02 Jan 2030 03:04:05 GMT", 2},
+		{"no sunset", []RouteOptionFunc{WithDeprecation(time.Time{}, "use /b")}, "true", "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var logs []string
+			l := funcr.New(func(_, args string) {
+				mu.Lock()
+				defer mu.Unlock()
+				logs = append(logs, args)
+			}, funcr.Options{})
+			c := New(WithLogger(l))
+			var calls atomic.Int32
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				calls.Add(1)
+				return []byte("a"), nil
+			}, tt.options...); err != nil {
+				t.Fatal(err)
+			}
+			for _, stage := range []string{"miss", "hit"} {
+				w := serve(t, c, http.MethodGet, "/a")
+				if got := w.Body.String(); w.Code != http.StatusOK || got != "a" {
+					t.Fatalf("%s: GET /a = %d %q, want 200 a", stage, w.Code, got)
+				}
+				if got := w.Header().Get("Deprecation"); got != tt.deprecation {
+					t.Errorf("%s: Deprecation = %q, want %q", stage, got, tt.deprecation)
+				}
+				if got := w.Header().Get("Sunset"); got != tt.sunset {
+					t.Errorf("%s: Sunset = %q, want %q", stage, got, tt.sunset)
+				}
+			}
+			if n := calls.Load(); n != 1 {
+				t.Errorf("handler called %d times, want 1", n)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			var warned int
+			for _, line := range logs {
+				if strings.Contains(line, `"msg"="deprecated route requested"`) {
+					warned++
+					if !strings.Contains(line, `"message"="use /b"`) {
+						t.Errorf("log line %q lacks the message", line)
+					}
+				}
+			}
+			if warned != tt.logs {
+				t.Errorf("logged %d deprecation warnings, want %d", warned, tt.logs)
+			}
+		})
+	}
+}
+
+func TestResponseTransform(t *testing.T) {
+	upper := func(b []byte) ([]byte, error) { return bytes.ToUpper(b), nil }
+	bang := func(b []byte) ([]byte, error) { return append(b, '!'), nil }
+	fail := func([]byte) ([]byte, error) { return nil, errors.New("boom") }
+	tests := []struct {
+		name    string
+		options []RouteOptionFunc
+		code    int
+		want    string
+		cached  string
+	}{
+		{"uppercase", []RouteOptionFunc{WithResponseTransform(upper)}, http.StatusOK, "HELLO", "HELLO"},
+		{"in order", []RouteOptionFunc{WithResponseTransform(upper), WithResponseTransform(bang)}, http.StatusOK, "HELLO!", "HELLO!"},
+		{"failing", []RouteOptionFunc{WithResponseTransform(fail)}, http.StatusInternalServerError, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			var calls atomic.Int32
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				calls.Add(1)
+				return []byte("hello"), nil
+			}, tt.options...); err != nil {
+				t.Fatal(err)
+			}
+			for _, stage := range []string{"miss", "hit"} {
+				w := serve(t, c, http.MethodGet, "/a")
+				if w.Code != tt.code {
+					t.Fatalf("%s: GET /a = %d, want %d", stage, w.Code, tt.code)
+				}
+				if got := w.Body.String(); tt.code == http.StatusOK && got != tt.want {
+					t.Errorf("%s: GET /a = %q, want %q", stage, got, tt.want)
+				}
+			}
+			var cached string
+			for _, info := range c.Dump() {
+				if info.Key == "/a" {
+					cached = string(info.Preview)
+				}
+			}
+			if cached != tt.cached {
+				t.Errorf("cached %q, want %q", cached, tt.cached)
+			}
+			if n := calls.Load(); tt.code == http.StatusOK && n != 1 {
+				t.Errorf("handler called %d times, want 1", n)
+			}
+		})
+	}
+	if err := WithResponseTransform(nil)(&route{}); err == nil {
+		t.Error("WithResponseTransform(nil) succeeded")
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	c := New(WithRewrite(func(r *http.Request) {
+		if p, ok := strings.CutPrefix(r.URL.Path, "/v1/"); ok {
+			r.URL.Path = "/" + p
+		}
+	}))
+	var calls atomic.Int32
+	if err := c.Register("/x", func([]string) ([]byte, error) {
+		calls.Add(1)
+		return []byte("x"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		code  int
+		calls int32
+	}{
+		{"/v1/x", http.StatusOK, 1},
+		{"/x", http.StatusOK, 1},
+		{"/v1/x", http.StatusOK, 1},
+		{"/v1/y", http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		w := serve(t, c, http.MethodGet, tt.path)
+		if w.Code != tt.code {
+			t.Fatalf("GET %s = %d, want %d", tt.path, w.Code, tt.code)
+		}
+		if got := w.Body.String(); tt.code == http.StatusOK && got != "x" {
+			t.Errorf("GET %s = %q, want x", tt.path, got)
+		}
+		if n := calls.Load(); n != tt.calls {
+			t.Errorf("after GET %s: handler called %d times, want %d", tt.path, n, tt.calls)
+		}
+	}
+	if got := c.Keys(); len(got) != 1 || got[0] != "/x" {
+		t.Errorf("Keys() = %q, want [/x]", got)
+	}
+}
+
+func TestDebugBypassHeader(t *testing.T) {
+	type step struct {
+		bypass bool
+		want   string
+		keys   int
+	}
+	tests := []struct {
+		name    string
+		trusted bool
+		steps   []step
+	}{
+		{"trusted", true, []step{
+			{true, "1", 0},
+			{false, "2", 1},
+			{true, "3", 1},
+			{false, "2", 1},
+		}},
+		{"untrusted", false, []step{
+			{true, "1", 1},
+			{false, "1", 1},
+			{true, "1", 1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithTrustedHeaders(tt.trusted), WithDebugBypassHeader("X-Debug"), WithDefaultTTL(time.Hour))
+			handler, _ := versioned()
+			if err := c.Register("/a", handler); err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range tt.steps {
+				var header []string
+				if s.bypass {
+					header = []string{"X-Debug", "1"}
+				}
+				w := serve(t, c, http.MethodGet, "/a", header...)
+				if got := w.Body.String(); w.Code != http.StatusOK || got != s.want {
+					t.Errorf("step %d: GET /a = %d %q, want 200 %q", i, w.Code, got, s.want)
+				}
+				if got := c.Keys(); len(got) != s.keys {
+					t.Errorf("step %d: Keys() = %q, want %d entries", i, got, s.keys)
+				}
+			}
+		})
+	}
+	if err := WithDebugBypassHeader("")(&cache{}); err == nil {
+		t.Error(`WithDebugBypassHeader("") succeeded`)
+	}
+}
+
+func TestMaxRoutes(t *testing.T) {
+	c := New(WithMaxRoutes(2))
+	tests := []struct {
+		op      string
+		path    string
+		wantErr bool
+	}{
+		{"register", "/a", false},
+		{"register", "/b/:id", false},
+		{"register", "/c", true},
+		{"register", "/a", false},
+		{"unregister", "/b/:id", false},
+		{"register", "/c", false},
+		{"register", "/*", true},
+		{"unregister", "/a", false},
+		{"register", "/*", false},
+	}
+	for i, tt := range tests {
+		var err error
+		if tt.op == "register" {
+			err = c.Register(tt.path, constant(tt.path))
+		} else {
+			err = c.Unregister(tt.path)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("step %d: %s %s = %v, want error %v", i, tt.op, tt.path, err, tt.wantErr)
+		}
+	}
+	if got := body(t, serve(t, c, http.MethodGet, "/c")); got != "/c" {
+		t.Errorf("GET /c = %q, want /c", got)
+	}
+	if err := WithMaxRoutes(0)(&cache{}); err == nil {
+		t.Error("WithMaxRoutes(0) succeeded")
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(c *cache, calls *atomic.Int32) error
+	}{
+		{"sentinel", func(c *cache, calls *atomic.Int32) error {
+			return c.Register("/a", func([]string) ([]byte, error) {
+				calls.Add(1)
+				return nil, ErrNoContent
+			})
+		}},
+		{"wrapped sentinel", func(c *cache, calls *atomic.Int32) error {
+			return c.Register("/a", func([]string) ([]byte, error) {
+				calls.Add(1)
+				return []byte("ignored"), fmt.Errorf("nothing to say: %w", ErrNoContent)
+			})
+		}},
+		{"response status", func(c *cache, calls *atomic.Int32) error {
+			return c.RegisterResponse("/a", func(context.Context, []string) (*Response, error) {
+				calls.Add(1)
+				return &Response{Status: http.StatusNoContent}, nil
+			})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithDefaultTTL(time.Hour))
+			var calls atomic.Int32
+			if err := tt.register(c, &calls); err != nil {
+				t.Fatal(err)
+			}
+			for _, stage := range []string{"miss", "hit"} {
+				w := serve(t, c, http.MethodGet, "/a")
+				if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+					t.Errorf("%s: GET /a = %d %q, want 204 without a body", stage, w.Code, w.Body.String())
+				}
+				if got := w.Header().Get("Content-Type"); got != "" {
+					t.Errorf("%s: Content-Type = %q, want none", stage, got)
+				}
+			}
+			if n := calls.Load(); n != 1 {
+				t.Errorf("handler called %d times, want 1", n)
+			}
+		})
+	}
+}
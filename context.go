@@ -0,0 +1,156 @@
+package minicache
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey int
+
+const (
+	mediaTypeKey contextKey = iota
+	versionKey
+	requestIDKey
+	loggerKey
+	depthKey
+	fillingKey
+	previousKey
+	routeKey
+	variantKey
+	paramsKey
+	bodyKey
+	variedKey
+	rejectedConnKey
+)
+
+type RouteKind int
+
+const (
+	// RouteStatic routes matched every segment literally.
+	RouteStatic RouteKind = iota
+	// RouteDynamic routes matched at least one segment through a wildcard
+	// or parameter.
+	RouteDynamic
+	// RouteCatchAll routes matched a prefix of the path and caught the
+	// remaining segments.
+	RouteCatchAll
+)
+
+func (k RouteKind) String() string {
+	switch k {
+	case RouteStatic:
+		return "static"
+	case RouteDynamic:
+		return "dynamic"
+	case RouteCatchAll:
+		return "catch-all"
+	}
+	return "unknown"
+}
+
+type routeMatch struct {
+	kind    RouteKind
+	pattern string
+}
+
+func routeKind(path []string, dynamic []bool) RouteKind {
+	if len(dynamic) < len(path) {
+		return RouteCatchAll
+	}
+	for _, d := range dynamic {
+		if d {
+			return RouteDynamic
+		}
+	}
+	return RouteStatic
+}
+
+// RouteKindFromContext reports how the request was matched and the pattern
+// of the route that matched it.
+func RouteKindFromContext(ctx context.Context) (RouteKind, string) {
+	m, _ := ctx.Value(routeKey).(routeMatch)
+	return m.kind, m.pattern
+}
+
+func MediaTypeFromContext(ctx context.Context) string {
+	mediaType, _ := ctx.Value(mediaTypeKey).(string)
+	return mediaType
+}
+
+func VersionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(versionKey).(string)
+	return version
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// ParamsFromContext returns the values of the named parameters, such as id
+// in "/users/:id", of the route that matched the request.
+func ParamsFromContext(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(paramsKey).(map[string]string)
+	return params
+}
+
+// BodyFromContext returns the request body of a route registered with
+// WithBodyInKey.
+func BodyFromContext(ctx context.Context) []byte {
+	body, _ := ctx.Value(bodyKey).([]byte)
+	return body
+}
+
+func depthFromContext(ctx context.Context) int {
+	depth, _ := ctx.Value(depthKey).(int)
+	return depth
+}
+
+// fillChain lists the keys being populated by the handlers a context has
+// passed through, innermost first.
+type fillChain struct {
+	key    string
+	parent *fillChain
+}
+
+func withFilling(ctx context.Context, key string) context.Context {
+	parent, _ := ctx.Value(fillingKey).(*fillChain)
+	return context.WithValue(ctx, fillingKey, &fillChain{key: key, parent: parent})
+}
+
+func isFilling(ctx context.Context, key string) bool {
+	for f, _ := ctx.Value(fillingKey).(*fillChain); f != nil; f = f.parent {
+		if f.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// detachedContext keeps the values of its parent but takes its cancellation
+// from the cache, so background work outlives the request that triggered it
+// but not the cache itself.
+type detachedContext struct {
+	parent context.Context
+	base   context.Context
+}
+
+func (c *cache) detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx, base: c.ctx}
+}
+
+func (d detachedContext) Deadline() (time.Time, bool) {
+	return d.base.Deadline()
+}
+
+func (d detachedContext) Done() <-chan struct{} {
+	return d.base.Done()
+}
+
+func (d detachedContext) Err() error {
+	return d.base.Err()
+}
+
+func (d detachedContext) Value(key any) any {
+	return d.parent.Value(key)
+}
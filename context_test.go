@@ -0,0 +1,38 @@
+package minicache
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRouteKindFromContext(t *testing.T) {
+	tests := []struct {
+		path    string
+		kind    RouteKind
+		pattern string
+	}{
+		{"/users", RouteStatic, "/users"},
+		{"/users/alice", RouteDynamic, "/users/:name"},
+		{"/users/alice/posts", RouteDynamic, "/users/:name/posts"},
+		{"/files/a/b/c", RouteCatchAll, "/files/*"},
+	}
+	c := New(WithDefaultTTL(time.Hour))
+	for _, tt := range tests {
+		if err := c.RegisterContext(tt.pattern, func(ctx context.Context, _ []string) ([]byte, error) {
+			kind, pattern := RouteKindFromContext(ctx)
+			return []byte(kind.String() + " " + pattern), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			want := tt.kind.String() + " " + tt.pattern
+			if got := body(t, serve(t, c, http.MethodGet, tt.path)); got != want {
+				t.Errorf("handler saw %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package minicache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// WithDebugEndpoint serves a JSON summary of the cache state at path. It
+// exposes every registered route and internal counters without any
+// authentication, so it should only be enabled where that is acceptable.
+// Requests to it bypass the cache and are not counted in Stats.
+func WithDebugEndpoint(path string) OptionFunc {
+	return func(c *cache) error {
+		if !strings.HasPrefix(path, "/") {
+			return errors.New("debug endpoint must be an absolute path")
+		}
+		c.debugPath = path
+		return nil
+	}
+}
+
+type debugState struct {
+	Stats   Stats       `json:"stats"`
+	Routes  []RouteInfo `json:"routes"`
+	Entries int         `json:"entries"`
+}
+
+func (c *cache) serveDebug(w http.ResponseWriter) {
+	c.RLock()
+	entries := len(c.cache)
+	c.RUnlock()
+	b, err := json.Marshal(debugState{Stats: c.Stats(), Routes: c.Routes(), Entries: entries})
+	if err != nil {
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,54 @@
+package minicache
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDebugEndpoint(t *testing.T) {
+	t.Run("relative path", func(t *testing.T) {
+		if err := WithDebugEndpoint("debug")(&cache{}); err == nil {
+			t.Error("WithDebugEndpoint(\"debug\") succeeded")
+		}
+	})
+	c := New(WithDefaultTTL(time.Hour), WithDebugEndpoint("/debug/minicache"))
+	if err := c.Register("/a", constant("a"), WithRouteMeta(map[string]string{"owner": "team-a"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register("/b/:id", constant("b")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/a", "/b/1"} {
+		serve(t, c, http.MethodGet, path)
+	}
+	for i := 0; i < 2; i++ {
+		w := serve(t, c, http.MethodGet, "/debug/minicache")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("GET debug endpoint = %d %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range []string{"stats", "routes", "entries"} {
+			if _, ok := fields[field]; !ok {
+				t.Errorf("no %s in %s", field, w.Body)
+			}
+		}
+		var state debugState
+		if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+		if want := (Stats{Hits: 1, Misses: 2, Entries: 2}); state.Stats != want {
+			t.Errorf("stats = %+v, want %+v without the debug requests", state.Stats, want)
+		}
+		if state.Entries != 2 {
+			t.Errorf("entries = %d, want 2", state.Entries)
+		}
+		if len(state.Routes) != 2 || state.Routes[0].Pattern != "/a" || state.Routes[0].Meta["owner"] != "team-a" || state.Routes[1].Pattern != "/b/:id" {
+			t.Errorf("routes = %+v", state.Routes)
+		}
+	}
+}
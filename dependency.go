@@ -0,0 +1,91 @@
+package minicache
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrDependencyUnavailable is what requests are answered with while the
+// check set with WithDependencyCheck fails.
+var ErrDependencyUnavailable = errors.New("dependency unavailable")
+
+// dependencyCheckInterval is how long the result of a dependency check is
+// reused before the check runs again.
+const dependencyCheckInterval = time.Second
+
+type dependencyCheck struct {
+	check     func() error
+	mu        sync.Mutex
+	err       error
+	checkedAt time.Time
+	// checking is set while a request runs the check, which other requests
+	// do not wait for, but answer by the previous result.
+	checking bool
+	// checked is closed once the first check has finished, as there is no
+	// previous result before.
+	checked chan struct{}
+}
+
+// WithDependencyCheck answers every request with 503, or the handler set
+// with WithOverloadHandler, while check fails. The result of check is reused
+// for a second, so a down backend is neither hammered nor waited on by each
+// request.
+func WithDependencyCheck(check func() error) OptionFunc {
+	return func(c *cache) error {
+		if check == nil {
+			return errors.New("dependency check must not be nil")
+		}
+		c.dependency = &dependencyCheck{check: check, checked: make(chan struct{})}
+		return nil
+	}
+}
+
+func (c *cache) dependencyHealthy(w http.ResponseWriter, r *http.Request) bool {
+	if c.dependency == nil {
+		return true
+	}
+	d := c.dependency
+	now := c.now()
+	d.mu.Lock()
+	refresh := !d.checking && (d.checkedAt.IsZero() || now.Sub(d.checkedAt) >= dependencyCheckInterval)
+	d.checking = d.checking || refresh
+	d.mu.Unlock()
+	if refresh {
+		c.checkDependency(r, now)
+	}
+	select {
+	case <-d.checked:
+	case <-r.Context().Done():
+		return false
+	}
+	d.mu.Lock()
+	err := d.err
+	d.mu.Unlock()
+	if err == nil {
+		return true
+	}
+	c.overloaded(w, r, ErrDependencyUnavailable)
+	return false
+}
+
+// checkDependency runs the dependency check started at now and records its
+// result.
+func (c *cache) checkDependency(r *http.Request, now time.Time) {
+	d := c.dependency
+	err := errors.New("dependency check panicked")
+	defer func() {
+		d.mu.Lock()
+		first := d.checkedAt.IsZero()
+		d.err, d.checkedAt, d.checking = err, now, false
+		d.mu.Unlock()
+		if first {
+			close(d.checked)
+		}
+		if err != nil {
+			c.logger(r.Context()).Error(err, "dependency check failed")
+		}
+	}()
+	err = d.check()
+}
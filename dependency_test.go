@@ -0,0 +1,67 @@
+package minicache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDependencyCheckIsSingleFlight(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	started, checks := make(chan struct{}), make(chan error)
+	c := New(WithClock(clock), WithDefaultTTL(time.Hour), WithDependencyCheck(func() error {
+		started <- struct{}{}
+		return <-checks
+	}))
+	if err := c.Register("/a", constant("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests wait for the first check, as there is no earlier result.
+	first := make(chan *httptest.ResponseRecorder)
+	for i := 0; i < 2; i++ {
+		go func() { first <- serve(t, c, http.MethodGet, "/a") }()
+	}
+	<-started
+	select {
+	case <-first:
+		t.Fatal("request answered before the first check finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+	checks <- nil
+	for i := 0; i < 2; i++ {
+		if w := <-first; w.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200", w.Code)
+		}
+	}
+
+	// Later, one request runs the check while the others are answered by
+	// the previous result.
+	mu.Lock()
+	now = now.Add(2 * dependencyCheckInterval)
+	mu.Unlock()
+	checking := make(chan *httptest.ResponseRecorder)
+	go func() { checking <- serve(t, c, http.MethodGet, "/a") }()
+	<-started
+	for i := 0; i < 3; i++ {
+		if w := serve(t, c, http.MethodGet, "/a"); w.Code != http.StatusOK {
+			t.Errorf("status = %d while the check runs, want the previous result", w.Code)
+		}
+	}
+	checks <- errors.New("down")
+	if w := <-checking; w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 from the failed check", w.Code)
+	}
+	if w := serve(t, c, http.MethodGet, "/a"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 until the next check", w.Code)
+	}
+}
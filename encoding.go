@@ -0,0 +1,107 @@
+package minicache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// acceptsEncoding reports whether an Accept-Encoding header allows coding,
+// either by name or through a wildcard.
+func acceptsEncoding(header, coding string) bool {
+	specific, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(k)) != "q" {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		switch name {
+		case coding:
+			specific = q
+		case "*":
+			wildcard = q
+		}
+	}
+	if specific >= 0 {
+		return specific > 0
+	}
+	return wildcard > 0
+}
+
+// identityBody holds the decompressed value of a gzipped entry, shared by
+// the copies of its entry data.
+type identityBody struct {
+	once  sync.Once
+	value []byte
+	err   error
+	// size is the length of value once it is set, counted against the
+	// partition of the entry.
+	size atomic.Int64
+}
+
+// bytes returns how much memory b adds to its entry.
+func (b *identityBody) bytes() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.size.Load()
+}
+
+func (d entryData) gzipped() bool {
+	return strings.EqualFold(d.header.Get("Content-Encoding"), "gzip")
+}
+
+// withIdentity prepares d, if gzipped, to keep its decompressed value once
+// a client that does not accept gzip asks for it.
+func (d entryData) withIdentity() entryData {
+	if d.gzipped() {
+		d.identity = &identityBody{}
+	}
+	return d
+}
+
+// decoded returns the decompressed value of d, of at most max bytes, and
+// whether this call decompressed the value kept for d.
+func (d entryData) decoded(max int64) (_ []byte, kept bool, _ error) {
+	if d.identity == nil {
+		b, err := gunzip(d.value, max)
+		return b, false, err
+	}
+	d.identity.once.Do(func() {
+		d.identity.value, d.identity.err = gunzip(d.value, max)
+		d.identity.size.Store(int64(len(d.identity.value)))
+		kept = d.identity.err == nil
+	})
+	return d.identity.value, kept, d.identity.err
+}
+
+// errDecodedTooLarge fails decompressing a body past the size limit.
+var errDecodedTooLarge = errors.New("decompressed response is too large")
+
+// gunzip decompresses b, failing with errDecodedTooLarge past max bytes, so
+// that a small compressed body cannot expand without bounds.
+func gunzip(b []byte, max int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err == nil && int64(len(out)) > max {
+		return nil, errDecodedTooLarge
+	}
+	return out, err
+}
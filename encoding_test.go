@@ -0,0 +1,180 @@
+package minicache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodedBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantStatus int
+		wantBytes  int64
+	}{
+		{"within the limit", 1000, http.StatusOK, 1000},
+		{"at the limit", 4096, http.StatusOK, 4096},
+		{"past the limit", 1 << 20, http.StatusInternalServerError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed := gzipped(t, make([]byte, tt.size))
+			c := New(WithMaxEntries(10), WithMaxStreamedBody(4096), WithDefaultTTL(time.Hour))
+			err := c.RegisterResponse("/z", func(context.Context, []string) (*Response, error) {
+				return &Response{Body: compressed, Header: http.Header{"Content-Encoding": {"gzip"}}}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w := serve(t, c, http.MethodGet, "/z", "Accept-Encoding", "gzip"); w.Code != http.StatusOK {
+				t.Fatalf("gzip status = %d, want 200", w.Code)
+			}
+			for i := 0; i < 2; i++ {
+				w := serve(t, c, http.MethodGet, "/z")
+				if w.Code != tt.wantStatus {
+					t.Fatalf("identity status = %d, want %d", w.Code, tt.wantStatus)
+				}
+				if w.Code == http.StatusOK && w.Body.Len() != tt.size {
+					t.Errorf("identity body is %d bytes, want %d", w.Body.Len(), tt.size)
+				}
+			}
+			c.RLock()
+			defer c.RUnlock()
+			if got, want := c.defaultPartition.bytes, int64(len(compressed))+tt.wantBytes; got != want {
+				t.Errorf("partition holds %d bytes, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestPreGzippedOverHTTP(t *testing.T) {
+	plain := []byte(strings.Repeat("hello, world\n", 100))
+	compressed := gzipped(t, plain)
+	var calls int32
+	c := New(WithDefaultTTL(time.Hour))
+	if err := c.RegisterResponse("/z", func(context.Context, []string) (*Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &Response{Body: compressed, Header: http.Header{"Content-Encoding": {"gzip"}}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	url := start(t, c) + "/z"
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		transport      *http.Transport
+		body           []byte
+		encoding       string
+	}{
+		{"gzip client", "gzip", &http.Transport{DisableCompression: true}, compressed, "gzip"},
+		{"identity client", "identity", &http.Transport{DisableCompression: true}, plain, ""},
+		{"no Accept-Encoding", "", &http.Transport{DisableCompression: true}, plain, ""},
+		{"transparently decompressing client", "", &http.Transport{}, plain, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			resp, err := (&http.Client{Transport: tt.transport}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(b, tt.body) {
+				t.Errorf("got %d with %d bytes, want 200 with %d", resp.StatusCode, len(b), len(tt.body))
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+}
+
+func TestBothRepresentationsFromOneEntry(t *testing.T) {
+	raw := []byte(strings.Repeat("hello ", 100))
+	compressed := gzipped(t, raw)
+	accepts := map[string]bool{"gzip": true, "gzip, deflate": true, "*": true}
+	tests := []struct {
+		name    string
+		clients []string
+	}{
+		{"gzip first", []string{"gzip", "", "gzip", "", ""}},
+		{"identity first", []string{"", "gzip", "", "gzip", "gzip"}},
+		{"refused gzip", []string{"gzip;q=0", "gzip, deflate", "*", "identity"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithMaxEntries(10), WithDefaultTTL(time.Hour))
+			var calls atomic.Int32
+			if err := c.RegisterResponse("/z", func(context.Context, []string) (*Response, error) {
+				calls.Add(1)
+				return &Response{Body: compressed, Header: http.Header{"Content-Encoding": {"gzip"}}}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for i, accept := range tt.clients {
+				w := serve(t, c, http.MethodGet, "/z", "Accept-Encoding", accept)
+				want, encoding := raw, ""
+				if accepts[accept] {
+					want, encoding = compressed, "gzip"
+				}
+				if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), want) {
+					t.Fatalf("request %d with Accept-Encoding %q = %d with %d bytes, want 200 with %d", i, accept, w.Code, w.Body.Len(), len(want))
+				}
+				if got := w.Header().Get("Content-Encoding"); got != encoding {
+					t.Errorf("request %d: Content-Encoding = %q, want %q", i, got, encoding)
+				}
+				if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+					t.Errorf("request %d: Vary = %q, want Accept-Encoding", i, got)
+				}
+			}
+			if n := calls.Load(); n != 1 {
+				t.Errorf("handler called %d times, want 1", n)
+			}
+			if got := c.Keys(); len(got) != 1 {
+				t.Errorf("Keys() = %q, want a single entry", got)
+			}
+			// The entry keeps one copy of each representation.
+			c.RLock()
+			defer c.RUnlock()
+			if got, want := c.defaultPartition.bytes, int64(len(compressed)+len(raw)); got != want {
+				t.Errorf("partition holds %d bytes, want %d", got, want)
+			}
+		})
+	}
+}
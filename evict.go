@@ -0,0 +1,58 @@
+package minicache
+
+// EvictReason tells why an entry was removed from the cache.
+type EvictReason int
+
+const (
+	// EvictPurged entries were removed by PurgeTag, PurgeFunc or Clear.
+	EvictPurged EvictReason = iota
+	// EvictReplaced entries were overwritten by Set.
+	EvictReplaced
+	// EvictDropped entries were renewed without a value to keep, because
+	// the handler reported none or the cache policy declined it.
+	EvictDropped
+	// EvictCapacity entries made room for new ones under WithMaxEntries.
+	EvictCapacity
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictPurged:
+		return "purged"
+	case EvictReplaced:
+		return "replaced"
+	case EvictDropped:
+		return "dropped"
+	case EvictCapacity:
+		return "capacity"
+	}
+	return "unknown"
+}
+
+// WithOnEvict calls f for every populated entry removed from the cache. f
+// runs without any cache lock held, so it may use the cache itself.
+func WithOnEvict(f func(key string, value []byte, reason EvictReason)) OptionFunc {
+	return func(c *cache) error {
+		c.onEvict = f
+		return nil
+	}
+}
+
+// evicted reports the removal of entry, which must no longer be in the
+// cache, unless it was never populated.
+func (c *cache) evicted(key string, entry *cacheEntry, reason EvictReason) {
+	if !entry.populated() {
+		return
+	}
+	c.counters.evictions.Add(1)
+	if c.metrics != nil {
+		c.metrics.OnEvict(key, reason)
+	}
+	if c.onEvict == nil {
+		return
+	}
+	entry.RLock()
+	value := entry.value
+	entry.RUnlock()
+	c.onEvict(key, value, reason)
+}
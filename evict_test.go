@@ -0,0 +1,80 @@
+package minicache
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOnEvict(t *testing.T) {
+	type eviction struct {
+		key, value string
+		reason     EvictReason
+	}
+	tests := []struct {
+		name   string
+		action func(t *testing.T, c *cache)
+		want   []eviction
+	}{
+		{"capacity", func(t *testing.T, c *cache) {
+			serve(t, c, http.MethodGet, "/c")
+		}, []eviction{{"/a", "a", EvictCapacity}}},
+		{"purge", func(t *testing.T, c *cache) {
+			if err := c.Purge("/b"); err != nil {
+				t.Fatal(err)
+			}
+		}, []eviction{{"/b", "b", EvictPurged}}},
+		{"purge tag", func(t *testing.T, c *cache) { c.PurgeTag("tagged") }, []eviction{{"/a", "a", EvictPurged}}},
+		{"set", func(t *testing.T, c *cache) {
+			if err := c.Set("/a", []byte("new"), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}, []eviction{{"/a", "a", EvictReplaced}}},
+		{"purge nothing", func(t *testing.T, c *cache) {
+			if err := c.Purge("/c"); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got []eviction
+			var c *cache
+			c = New(WithMaxEntries(2), WithDefaultTTL(time.Hour), WithOnEvict(func(key string, value []byte, reason EvictReason) {
+				// The callback may use the cache without deadlocking.
+				c.Keys()
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, eviction{key, string(value), reason})
+			}))
+			for _, path := range []string{"/a", "/b", "/c"} {
+				path := path
+				if err := c.RegisterResponse(path, func(context.Context, []string) (*Response, error) {
+					resp := &Response{Body: []byte(path[1:])}
+					if path == "/a" {
+						resp.Tags = []string{"tagged"}
+					}
+					return resp, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			serve(t, c, http.MethodGet, "/a")
+			serve(t, c, http.MethodGet, "/b")
+			tt.action(t, c)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(got) != len(tt.want) {
+				t.Fatalf("evictions = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("eviction %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package minicache
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+)
+
+// EvictionPolicy decides which entry to evict once the cache holds as many
+// entries as WithMaxEntries allows. The cache serializes all calls.
+type EvictionPolicy interface {
+	// RecordAccess notes that key was added to the cache or read from it.
+	RecordAccess(key string)
+	// Remove forgets key, which left the cache for another reason.
+	Remove(key string)
+	// Evict removes and returns the key to evict next, reporting false if
+	// no key is tracked.
+	Evict() (string, bool)
+}
+
+// WithMaxEntries bounds the number of entries outside the partitions
+// declared with WithPartitionLimit, evicting entries picked by the eviction
+// policy, LRU by default, to make room for new ones.
+func WithMaxEntries(n int) OptionFunc {
+	return func(c *cache) error {
+		if n < 1 {
+			return errors.New("maximum entries must be positive")
+		}
+		c.maxEntries = n
+		return nil
+	}
+}
+
+// WithEvictionPolicy picks the entries evicted to stay within the limit set
+// by WithMaxEntries, which it requires: New panics without it. Pinned and
+// just added entries are passed over. A policy not from this package gives
+// them up from Evict, and is then given them back through RecordAccess.
+func WithEvictionPolicy(p EvictionPolicy) OptionFunc {
+	return func(c *cache) error {
+		if p == nil {
+			return errors.New("eviction policy must not be nil")
+		}
+		c.evictionPolicy = p
+		return nil
+	}
+}
+
+type eviction struct {
+	key   string
+	entry *cacheEntry
+}
+
+// insertLocked adds entry under key, first evicting as many entries of its
+// partition as it takes to stay within the partition's limits. The evicted
+// entries are returned to be reported once the cache lock is released.
+func (c *cache) insertLocked(key string, entry *cacheEntry) []eviction {
+	if entry.partition == nil {
+		entry.partition = c.defaultPartition
+	}
+	p := entry.partition
+	var evicted []eviction
+	old, replacing := c.cache[key]
+	if replacing && old.partition != p {
+		old.partition.forget(key)
+		replacing = false
+	}
+	if !replacing {
+		evicted = c.evictLocked(p, "", p.full)
+	}
+	c.cache[key] = entry
+	p.record(key, int64(len(entry.value))+entry.identity.bytes())
+	return append(evicted, c.evictLocked(p, key, p.oversized)...)
+}
+
+// resized accounts for the new value of entry under key, evicting other
+// entries of its partition if it went over its size limit.
+func (c *cache) resized(key string, entry *cacheEntry) {
+	entry.RLock()
+	size := int64(len(entry.value)) + entry.identity.bytes()
+	entry.RUnlock()
+	c.Lock()
+	var evicted []eviction
+	if c.cache[key] == entry {
+		entry.partition.record(key, size)
+		evicted = c.evictLocked(entry.partition, key, entry.partition.oversized)
+	}
+	c.Unlock()
+	c.reportEvicted(evicted, EvictCapacity)
+}
+
+// identityDecoded accounts for the decompressed value identity kept for the
+// entry under key, if it is still cached.
+func (c *cache) identityDecoded(key string, identity *identityBody) {
+	c.RLock()
+	entry := c.cache[key]
+	c.RUnlock()
+	if entry == nil {
+		return
+	}
+	entry.RLock()
+	current := entry.identity == identity
+	entry.RUnlock()
+	if current {
+		c.resized(key, entry)
+	}
+}
+
+// evictLocked evicts entries of p while over reports true, sparing keep and
+// pinned entries.
+func (c *cache) evictLocked(p *partition, keep string, over func() bool) []eviction {
+	if p.policy == nil {
+		return nil
+	}
+	var evicted []eviction
+	var spared []string
+	defer func() {
+		for _, key := range spared {
+			p.policy.RecordAccess(key)
+		}
+	}()
+	next := p.policy.Evict
+	if s, ok := p.policy.(skippingPolicy); ok {
+		next = func() (string, bool) {
+			return s.evictSkipping(func(key string) bool {
+				return key == keep || c.pinnedLocked(key)
+			})
+		}
+	}
+	for over() {
+		victim, ok := next()
+		if !ok {
+			break
+		}
+		if victim == keep {
+			p.policy.RecordAccess(keep)
+			break
+		}
+		if c.pinnedLocked(victim) {
+			spared = append(spared, victim)
+			continue
+		}
+		p.bytes -= p.sizes[victim]
+		delete(p.sizes, victim)
+		if e, ok := c.cache[victim]; ok && e.partition == p {
+			delete(c.cache, victim)
+			c.untagLocked(victim)
+			c.unvaryLocked(victim)
+			evicted = append(evicted, eviction{key: victim, entry: e})
+		}
+	}
+	return evicted
+}
+
+// Pin exempts the entries for path, including its variants, from eviction
+// to make room for other entries. They still expire and are renewed.
+func (c *cache) Pin(path string) error {
+	key, _, err := c.pathKey(path)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.pinned == nil {
+		c.pinned = make(map[string]bool)
+	}
+	c.pinned[key] = true
+	return nil
+}
+
+// Unpin undoes Pin.
+func (c *cache) Unpin(path string) error {
+	key, _, err := c.pathKey(path)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.pinned, key)
+	return nil
+}
+
+func (c *cache) pinnedLocked(key string) bool {
+	for pinned := range c.pinned {
+		if variantOf(key, pinned) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cache) accessedLocked(key string, entry *cacheEntry) {
+	if entry.partition.policy != nil {
+		entry.partition.policy.RecordAccess(key)
+	}
+}
+
+func (c *cache) forgetLocked(key string, entry *cacheEntry) {
+	entry.partition.forget(key)
+}
+
+func (c *cache) reportEvicted(evicted []eviction, reason EvictReason) {
+	for _, e := range evicted {
+		c.evicted(e.key, e.entry, reason)
+	}
+}
+
+// skippingPolicy is implemented by the policies of this package, which can
+// pass over the keys evictLocked spares without losing track of them.
+type skippingPolicy interface {
+	// evictSkipping is Evict for the keys skip returns false for.
+	evictSkipping(skip func(key string) bool) (string, bool)
+}
+
+// orderPolicy evicts the front of a list, moving keys to the back on insert
+// and, if touch is set, on every access.
+type orderPolicy struct {
+	order *list.List
+	elems map[string]*list.Element
+	touch bool
+}
+
+// NewLRU returns a policy evicting the least recently used entry.
+func NewLRU() EvictionPolicy {
+	return &orderPolicy{order: list.New(), elems: make(map[string]*list.Element), touch: true}
+}
+
+// NewFIFO returns a policy evicting the oldest entry, however often it is
+// read.
+func NewFIFO() EvictionPolicy {
+	return &orderPolicy{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *orderPolicy) RecordAccess(key string) {
+	if e, ok := p.elems[key]; ok {
+		if p.touch {
+			p.order.MoveToBack(e)
+		}
+		return
+	}
+	p.elems[key] = p.order.PushBack(key)
+}
+
+func (p *orderPolicy) Remove(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *orderPolicy) Evict() (string, bool) {
+	e := p.order.Front()
+	if e == nil {
+		return "", false
+	}
+	key := p.order.Remove(e).(string)
+	delete(p.elems, key)
+	return key, true
+}
+
+func (p *orderPolicy) evictSkipping(skip func(key string) bool) (string, bool) {
+	for e := p.order.Front(); e != nil; e = e.Next() {
+		if key := e.Value.(string); !skip(key) {
+			p.Remove(key)
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// lfuPolicy keeps a list of keys per access count, each in order of last
+// access, so that ties are broken by recency.
+type lfuPolicy struct {
+	counts  map[string]int
+	elems   map[string]*list.Element
+	buckets map[int]*list.List
+	min     int
+}
+
+// NewLFU returns a policy evicting the least frequently used entry, and of
+// those the least recently used one.
+func NewLFU() EvictionPolicy {
+	return &lfuPolicy{counts: make(map[string]int), elems: make(map[string]*list.Element), buckets: make(map[int]*list.List)}
+}
+
+func (p *lfuPolicy) RecordAccess(key string) {
+	n := p.counts[key]
+	if n > 0 {
+		p.unlink(key, n)
+	}
+	n++
+	if p.buckets[n] == nil {
+		p.buckets[n] = list.New()
+	}
+	p.counts[key] = n
+	p.elems[key] = p.buckets[n].PushBack(key)
+	if n == 1 || n-1 == p.min && p.buckets[p.min] == nil {
+		p.min = n
+	}
+}
+
+func (p *lfuPolicy) unlink(key string, n int) {
+	p.buckets[n].Remove(p.elems[key])
+	if p.buckets[n].Len() == 0 {
+		delete(p.buckets, n)
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if n, ok := p.counts[key]; ok {
+		p.unlink(key, n)
+		delete(p.counts, key)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lfuPolicy) Evict() (string, bool) {
+	if len(p.counts) == 0 {
+		return "", false
+	}
+	if p.buckets[p.min] == nil {
+		// The least used keys were removed, find the next least used.
+		p.min = 0
+		for n := range p.buckets {
+			if p.min == 0 || n < p.min {
+				p.min = n
+			}
+		}
+	}
+	key := p.buckets[p.min].Front().Value.(string)
+	p.Remove(key)
+	return key, true
+}
+
+func (p *lfuPolicy) evictSkipping(skip func(key string) bool) (string, bool) {
+	counts := make([]int, 0, len(p.buckets))
+	for n := range p.buckets {
+		counts = append(counts, n)
+	}
+	sort.Ints(counts)
+	for _, n := range counts {
+		for e := p.buckets[n].Front(); e != nil; e = e.Next() {
+			if key := e.Value.(string); !skip(key) {
+				p.Remove(key)
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,191 @@
+package minicache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEvictSkipping(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   EvictionPolicy
+		accesses []string
+		skip     map[string]bool
+		want     []string
+	}{
+		{"LRU", NewLRU(), []string{"a", "b", "c", "a"}, map[string]bool{"b": true}, []string{"c", "a"}},
+		{"FIFO", NewFIFO(), []string{"a", "b", "c", "a"}, map[string]bool{"a": true}, []string{"b", "c"}},
+		{"LFU", NewLFU(), []string{"a", "b", "b", "c", "c", "c"}, map[string]bool{"a": true}, []string{"b", "c"}},
+		{"LFU all skipped", NewLFU(), []string{"a", "b"}, map[string]bool{"a": true, "b": true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range tt.accesses {
+				tt.policy.RecordAccess(key)
+			}
+			s := tt.policy.(skippingPolicy)
+			var got []string
+			for {
+				key, ok := s.evictSkipping(func(key string) bool { return tt.skip[key] })
+				if !ok {
+					break
+				}
+				got = append(got, key)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("evicted %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("evicted %v, want %v", got, tt.want)
+				}
+			}
+			// The skipped keys are still tracked as they were.
+			for range tt.skip {
+				if _, ok := tt.policy.Evict(); !ok {
+					t.Fatal("a skipped key is no longer tracked")
+				}
+			}
+		})
+	}
+}
+
+func TestLFUKeepsCountsOfSparedEntries(t *testing.T) {
+	c := New(WithMaxEntries(3), WithEvictionPolicy(NewLFU()), WithDefaultTTL(time.Hour))
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		if err := c.Register(path, constant(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serve(t, c, http.MethodGet, "/a")
+	if err := c.Pin("/a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		serve(t, c, http.MethodGet, "/b")
+	}
+	serve(t, c, http.MethodGet, "/c")
+	serve(t, c, http.MethodGet, "/c")
+	lfu := c.defaultPartition.policy.(*lfuPolicy)
+	a, b := lfu.counts["/a"], lfu.counts["/b"]
+	serve(t, c, http.MethodGet, "/d")
+	if lfu.counts["/a"] != a || lfu.counts["/b"] != b {
+		t.Errorf("access counts = %v, want /a at %d and /b at %d", lfu.counts, a, b)
+	}
+	c.RLock()
+	defer c.RUnlock()
+	for key, want := range map[string]bool{"/a": true, "/b": true, "/c": false, "/d": true} {
+		if _, ok := c.cache[key]; ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestEvictionPolicyRequiresMaxEntries(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("New did not panic")
+		}
+	}()
+	New(WithEvictionPolicy(NewLFU()))
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	revisited := []string{"/a", "/b", "/a", "/c"}
+	frequent := []string{"/a", "/a", "/a", "/b", "/c"}
+	tests := []struct {
+		name     string
+		policy   EvictionPolicy
+		requests []string
+		evicted  string
+	}{
+		{"default is LRU", nil, revisited, "/b"},
+		{"LRU", NewLRU(), revisited, "/b"},
+		{"LRU of frequent", NewLRU(), frequent, "/a"},
+		{"FIFO", NewFIFO(), revisited, "/a"},
+		{"FIFO of frequent", NewFIFO(), frequent, "/a"},
+		{"LFU", NewLFU(), revisited, "/b"},
+		{"LFU of frequent", NewLFU(), frequent, "/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := []OptionFunc{WithMaxEntries(2), WithDefaultTTL(time.Hour)}
+			if tt.policy != nil {
+				options = append(options, WithEvictionPolicy(tt.policy))
+			}
+			c := New(options...)
+			for _, path := range []string{"/a", "/b", "/c"} {
+				if err := c.Register(path, constant(path)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, path := range tt.requests {
+				serve(t, c, http.MethodGet, path)
+			}
+			c.RLock()
+			defer c.RUnlock()
+			if len(c.cache) != 2 {
+				t.Errorf("%d entries cached, want 2", len(c.cache))
+			}
+			for _, path := range []string{"/a", "/b", "/c"} {
+				if _, ok := c.cache[path]; ok == (path == tt.evicted) {
+					t.Errorf("%s cached = %v, want %s evicted", path, ok, tt.evicted)
+				}
+			}
+		})
+	}
+}
+
+func TestPinKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		options []RouteOptionFunc
+		path    string
+		accept  string
+		key     string
+	}{
+		{"path", "/p/:id", nil, "/p/1", "", "/p/1"},
+		{"key segments", "/x/:id/:rest", []RouteOptionFunc{WithKeySegments(1)}, "/x/1/a", "", "/1?route=%2Fx%2F%3Aid%2F%3Arest"},
+		{"key func", "/k/:id", []RouteOptionFunc{WithRouteKeyFunc(func(_ *http.Request, p []string) string {
+			return "user:" + p[1]
+		})}, "/k/7", "", "user:7"},
+		{"variant", "/v/:id", []RouteOptionFunc{WithAcceptVariants("application/json")}, "/v/2", "application/json", "/v/2?accept=application%2Fjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithMaxEntries(2), WithDefaultTTL(time.Hour))
+			if err := c.Register(tt.pattern, constant("pinned"), tt.options...); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Register("/f/:n", constant("filler")); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Pin(tt.path); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, tt.path, "Accept", tt.accept)
+			for _, path := range []string{"/f/1", "/f/2", "/f/3"} {
+				serve(t, c, http.MethodGet, path)
+			}
+			c.RLock()
+			_, pinned := c.cache[tt.key]
+			c.RUnlock()
+			if !pinned {
+				t.Fatalf("pinned entry %s was evicted", tt.key)
+			}
+			if err := c.Unpin(tt.path); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/f/4")
+			serve(t, c, http.MethodGet, "/f/5")
+			c.RLock()
+			_, cached := c.cache[tt.key]
+			c.RUnlock()
+			if cached {
+				t.Errorf("unpinned entry %s was not evicted", tt.key)
+			}
+		})
+	}
+}
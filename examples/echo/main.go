@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/url"
 
 	"github.com/lllamnyp/minicache"
@@ -8,15 +11,21 @@ import (
 
 func main() {
 	c := minicache.New()
-	echo := func(p []string) []byte {
-		b := make([]byte, 0)
-		for i := range p {
-			push, _ := url.PathUnescape(p[i])
-			b = append(b, []byte(push)...)
-			b = append(b, '\n')
-		}
-		return b
+	// The echo is streamed, so the client sees every line as soon as it is
+	// written, however many there are.
+	echo := func(ctx context.Context, p []string) (*minicache.Response, error) {
+		r, w := io.Pipe()
+		go func() {
+			for i := range p {
+				push, _ := url.PathUnescape(p[i])
+				if _, err := fmt.Fprintln(w, push); err != nil {
+					return
+				}
+			}
+			w.Close()
+		}()
+		return &minicache.Response{Stream: r}, nil
 	}
-	c.Register("/", echo)
+	c.RegisterResponse("/", echo)
 	c.ListenAndServe(":8080")
 }
@@ -2,4 +2,8 @@ module github.com/lllamnyp/minicache
 
 go 1.20
 
-require github.com/go-logr/logr v1.2.4
+require (
+	github.com/go-logr/logr v1.2.4
+	golang.org/x/net v0.35.0
+	golang.org/x/text v0.22.0
+)
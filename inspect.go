@@ -0,0 +1,153 @@
+package minicache
+
+import (
+	"sort"
+	"time"
+)
+
+const dumpPreviewLen = 64
+
+type EntryInfo struct {
+	Key     string
+	Size    int
+	Expiry  time.Time
+	Preview []byte
+}
+
+// snapshot copies the key to entry mapping so that entries can be inspected
+// without holding the cache lock.
+func (c *cache) snapshot() map[string]*cacheEntry {
+	c.RLock()
+	defer c.RUnlock()
+	entries := make(map[string]*cacheEntry, len(c.cache))
+	for k, e := range c.cache {
+		entries[k] = e
+	}
+	return entries
+}
+
+// populated reports whether e holds a value, rather than a fill that is in
+// progress or failed.
+func (e *cacheEntry) populated() bool {
+	select {
+	case <-e.ready:
+		return e.err == nil
+	default:
+		return false
+	}
+}
+
+// Dump describes the populated entries, sorted by key.
+func (c *cache) Dump() []EntryInfo {
+	entries := c.snapshot()
+	out := make([]EntryInfo, 0, len(entries))
+	for k, e := range entries {
+		if !e.populated() {
+			continue
+		}
+		e.RLock()
+		info := EntryInfo{Key: k, Size: len(e.value), Expiry: e.expiry}
+		preview := e.value
+		if len(preview) > dumpPreviewLen {
+			preview = preview[:dumpPreviewLen]
+		}
+		info.Preview = append([]byte(nil), preview...)
+		e.RUnlock()
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// Keys lists the keys of the populated entries, sorted.
+func (c *cache) Keys() []string {
+	entries := c.snapshot()
+	keys := make([]string, 0, len(entries))
+	for k, e := range entries {
+		if e.populated() {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Range calls f for every entry populated when Range was called, in key
+// order, until f returns false.
+func (c *cache) Range(f func(key string, expiry time.Time) bool) {
+	entries := c.snapshot()
+	keys := make([]string, 0, len(entries))
+	for k, e := range entries {
+		if e.populated() {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e := entries[k]
+		e.RLock()
+		expiry := e.expiry
+		e.RUnlock()
+		if !f(k, expiry) {
+			return
+		}
+	}
+}
+
+func (c *cache) trackRenewal(key string, delta int) {
+	c.renewalsMu.Lock()
+	defer c.renewalsMu.Unlock()
+	if c.inFlightRenewals == nil {
+		c.inFlightRenewals = make(map[string]int)
+	}
+	c.inFlightRenewals[key] += delta
+	if c.inFlightRenewals[key] <= 0 {
+		delete(c.inFlightRenewals, key)
+	}
+}
+
+// InFlightRenewals lists the keys being renewed in the background.
+func (c *cache) InFlightRenewals() []string {
+	c.renewalsMu.Lock()
+	keys := make([]string, 0, len(c.inFlightRenewals))
+	for k := range c.inFlightRenewals {
+		keys = append(keys, k)
+	}
+	c.renewalsMu.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+type RouteInfo struct {
+	Pattern string            `json:"pattern"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// Routes lists every route with a handler, sorted by pattern.
+func (c *cache) Routes() []RouteInfo {
+	out := make([]RouteInfo, 0, 8)
+	var walk func(r *route)
+	walk = func(r *route) {
+		if r.handler != nil {
+			info := RouteInfo{Pattern: r.pattern}
+			if len(r.meta) > 0 {
+				info.Meta = make(map[string]string, len(r.meta))
+				for k, v := range r.meta {
+					info.Meta[k] = v
+				}
+			}
+			out = append(out, info)
+		}
+		for _, child := range r.staticChildren {
+			walk(child)
+		}
+		for _, child := range r.dynamicChildren {
+			walk(child)
+		}
+	}
+	c.routesMu.RLock()
+	walk(c.root)
+	c.routesMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Pattern < out[j].Pattern })
+	return out
+}
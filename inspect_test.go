@@ -0,0 +1,208 @@
+package minicache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDump(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(WithDefaultTTL(time.Minute), WithClock(func() time.Time { return now }))
+	long := strings.Repeat("x", 100)
+	for path, value := range map[string]string{"/a": "aaa", "/b": long, "/empty": ""} {
+		if err := c.Register(path, constant(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.RegisterResponse("/ttl", func(context.Context, []string) (*Response, error) {
+		return &Response{Body: []byte("t"), TTL: time.Hour}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	if err := c.Register("/filling", func([]string) ([]byte, error) {
+		close(started)
+		<-release
+		return []byte("late"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/b", "/a", "/empty", "/ttl"} {
+		serve(t, c, http.MethodGet, path)
+	}
+	go serve(t, c, http.MethodGet, "/filling")
+	<-started
+	tests := []EntryInfo{
+		{Key: "/a", Size: 3, Expiry: now.Add(time.Minute), Preview: []byte("aaa")},
+		{Key: "/b", Size: 100, Expiry: now.Add(time.Minute), Preview: []byte(long[:dumpPreviewLen])},
+		{Key: "/empty", Size: 0, Expiry: now.Add(time.Minute), Preview: []byte{}},
+		{Key: "/ttl", Size: 1, Expiry: now.Add(time.Hour), Preview: []byte("t")},
+	}
+	got := c.Dump()
+	if len(got) != len(tests) {
+		t.Fatalf("Dump() = %+v, want %d entries without the one being filled", got, len(tests))
+	}
+	for i, want := range tests {
+		t.Run(want.Key, func(t *testing.T) {
+			g := got[i]
+			if g.Key != want.Key || g.Size != want.Size || !g.Expiry.Equal(want.Expiry) || !bytes.Equal(g.Preview, want.Preview) {
+				t.Errorf("entry %d = %+v, want %+v", i, g, want)
+			}
+		})
+	}
+}
+
+func TestKeysAndRange(t *testing.T) {
+	c := New(WithDefaultTTL(time.Hour))
+	if err := c.Register("/items/:id", func(p []string) ([]byte, error) { return []byte(p[0]), nil }); err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	if err := c.Register("/filling", func([]string) ([]byte, error) {
+		close(started)
+		<-release
+		return []byte("late"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/items/c", "/items/a", "/items/b"} {
+		serve(t, c, http.MethodGet, path)
+	}
+	go serve(t, c, http.MethodGet, "/filling")
+	<-started
+	populated := []string{"/items/a", "/items/b", "/items/c"}
+	if got := c.Keys(); strings.Join(got, ",") != strings.Join(populated, ",") {
+		t.Errorf("Keys() = %v, want %v", got, populated)
+	}
+	tests := []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		{"all", -1, populated},
+		{"early stop", 2, populated[:2]},
+		{"stop at first", 1, populated[:1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			c.Range(func(key string, expiry time.Time) bool {
+				if expiry.IsZero() {
+					t.Errorf("%s has no expiry", key)
+				}
+				got = append(got, key)
+				return len(got) != tt.limit
+			})
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Range visited %v, want %v", got, tt.want)
+			}
+		})
+	}
+	t.Run("modified while ranging", func(t *testing.T) {
+		var got []string
+		c.Range(func(key string, _ time.Time) bool {
+			got = append(got, key)
+			if err := c.Purge("/items/c"); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/items/d")
+			return true
+		})
+		if strings.Join(got, ",") != strings.Join(populated, ",") {
+			t.Errorf("Range visited %v, want the snapshot %v", got, populated)
+		}
+	})
+}
+
+func TestRouteMeta(t *testing.T) {
+	meta := map[string]string{"description": "lists users", "owner": "team-a"}
+	c := New()
+	if err := c.Register("/users", constant("u"), WithRouteMeta(meta), WithRouteMeta(map[string]string{"owner": "team-b", "tag": "public"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register("/users/:id", constant("u"), WithRouteMeta(map[string]string{"description": "one user"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register("/plain", constant("p")); err != nil {
+		t.Fatal(err)
+	}
+	meta["description"] = "changed after registering"
+	tests := []RouteInfo{
+		{Pattern: "/plain"},
+		{Pattern: "/users", Meta: map[string]string{"description": "lists users", "owner": "team-b", "tag": "public"}},
+		{Pattern: "/users/:id", Meta: map[string]string{"description": "one user"}},
+	}
+	got := c.Routes()
+	if len(got) != len(tests) {
+		t.Fatalf("Routes() = %+v, want %d routes", got, len(tests))
+	}
+	for i, want := range tests {
+		t.Run(want.Pattern, func(t *testing.T) {
+			if got[i].Pattern != want.Pattern || len(got[i].Meta) != len(want.Meta) {
+				t.Fatalf("route %d = %+v, want %+v", i, got[i], want)
+			}
+			for k, v := range want.Meta {
+				if got[i].Meta[k] != v {
+					t.Errorf("meta %s = %q, want %q", k, got[i].Meta[k], v)
+				}
+			}
+		})
+	}
+	got[1].Meta["owner"] = "changed by the caller"
+	if owner := c.Routes()[1].Meta["owner"]; owner != "team-b" {
+		t.Errorf("owner = %q after changing a returned map, want team-b", owner)
+	}
+}
+
+func TestInFlightRenewals(t *testing.T) {
+	var offset atomic.Int64
+	start := time.Now()
+	c := New(WithDefaultTTL(time.Minute), WithClock(func() time.Time {
+		return start.Add(time.Duration(offset.Load()))
+	}))
+	var mu sync.Mutex
+	filled := make(map[string]bool)
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	if err := c.Register("/k/:id", func(p []string) ([]byte, error) {
+		mu.Lock()
+		renewal := filled[p[1]]
+		filled[p[1]] = true
+		mu.Unlock()
+		if renewal {
+			started <- p[1]
+			<-release
+		}
+		return []byte(p[1]), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/k/a", "/k/b", "/k/c"} {
+		serve(t, c, http.MethodGet, path)
+	}
+	if got := c.InFlightRenewals(); len(got) != 0 {
+		t.Fatalf("InFlightRenewals() = %v before anything went stale", got)
+	}
+	offset.Store(int64(time.Hour))
+	for _, path := range []string{"/k/c", "/k/a"} {
+		serve(t, c, http.MethodGet, path)
+		<-started
+	}
+	if got := strings.Join(c.InFlightRenewals(), ","); got != "/k/a,/k/c" {
+		t.Errorf("InFlightRenewals() = %s while renewing, want /k/a,/k/c", got)
+	}
+	close(release)
+	settled(t, c, "/k/a")
+	settled(t, c, "/k/c")
+	if got := c.InFlightRenewals(); len(got) != 0 {
+		t.Errorf("InFlightRenewals() = %v once renewed, want none", got)
+	}
+}
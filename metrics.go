@@ -0,0 +1,24 @@
+package minicache
+
+import "time"
+
+// MetricsHook receives cache events, to be bridged to any metrics system.
+// Its methods are called synchronously and should return quickly.
+type MetricsHook interface {
+	OnHit(key string)
+	OnMiss(key string)
+	// OnRenew is called after every renewal of a stale entry, with the
+	// error it failed with, if any.
+	OnRenew(key string, err error)
+	OnEvict(key string, reason EvictReason)
+	// OnHandlerDuration is called with the run time of every handler call
+	// made to fill or renew an entry.
+	OnHandlerDuration(key string, d time.Duration)
+}
+
+func WithMetricsHook(h MetricsHook) OptionFunc {
+	return func(c *cache) error {
+		c.metrics = h
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+package minicache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingHook records every event it is called with.
+type recordingHook struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHook) record(format string, args ...any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, fmt.Sprintf(format, args...))
+}
+
+func (h *recordingHook) OnHit(key string)  { h.record("hit %s", key) }
+func (h *recordingHook) OnMiss(key string) { h.record("miss %s", key) }
+func (h *recordingHook) OnRenew(key string, err error) {
+	h.record("renew %s %v", key, err)
+}
+func (h *recordingHook) OnEvict(key string, reason EvictReason) {
+	h.record("evict %s %s", key, reason)
+}
+func (h *recordingHook) OnHandlerDuration(key string, d time.Duration) {
+	h.record("handler %s %v", key, d)
+}
+
+// take returns the events recorded since it was last called.
+func (h *recordingHook) take() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := h.events
+	h.events = nil
+	return events
+}
+
+func TestMetricsHook(t *testing.T) {
+	errDown := errors.New("down")
+	hook := &recordingHook{}
+	var offset atomic.Int64
+	start := time.Now()
+	c := New(WithMetricsHook(hook), WithDefaultTTL(time.Minute), WithoutBackgroundRenewal(), WithClock(func() time.Time {
+		return start.Add(time.Duration(offset.Load()))
+	}))
+	var failing atomic.Bool
+	if err := c.Register("/a", func([]string) ([]byte, error) {
+		offset.Add(int64(3 * time.Second))
+		if failing.Load() {
+			return nil, errDown
+		}
+		return []byte("a"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name   string
+		action func()
+		want   []string
+	}{
+		{"miss", func() { serve(t, c, http.MethodGet, "/a") }, []string{"miss /a", "handler /a 3s"}},
+		{"hit", func() { serve(t, c, http.MethodGet, "/a") }, []string{"hit /a"}},
+		{"renewal", func() {
+			offset.Add(int64(time.Hour))
+			serve(t, c, http.MethodGet, "/a")
+		}, []string{"hit /a", "handler /a 3s", "renew /a <nil>"}},
+		{"failed renewal", func() {
+			offset.Add(int64(time.Hour))
+			failing.Store(true)
+			serve(t, c, http.MethodGet, "/a")
+		}, []string{"hit /a", "handler /a 3s", "renew /a down"}},
+		{"purge", func() {
+			if err := c.Purge("/a"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"evict /a purged"}},
+		{"unrouted", func() { serve(t, c, http.MethodGet, "/none") }, nil},
+	}
+	for _, s := range steps {
+		t.Run(s.name, func(t *testing.T) {
+			s.action()
+			if got := hook.take(); strings.Join(got, "; ") != strings.Join(s.want, "; ") {
+				t.Errorf("events = %q, want %q", got, s.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Package minicachetest runs a cache, or any other handler, behind a test
+// HTTP server for end-to-end tests.
+package minicachetest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+)
+
+// Server is a test HTTP server serving a handler, usually a cache.
+type Server struct {
+	// URL is the base URL of the server, without a trailing slash.
+	URL string
+	// Client is a client sending requests to the server.
+	Client *http.Client
+	srv    *httptest.Server
+}
+
+// NewServer starts a server serving h. The caller closes it when done.
+func NewServer(h http.Handler) *Server {
+	srv := httptest.NewServer(h)
+	return &Server{
+		URL:    srv.URL,
+		Client: srv.Client(),
+		srv:    srv,
+	}
+}
+
+// Close shuts the server down, waiting for outstanding requests.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Get sends a GET request for path, such as "/users/1", to the server.
+func (s *Server) Get(path string) (*http.Response, error) {
+	return s.Client.Get(s.URL + path)
+}
+
+// GetBody sends a GET request for path to the server and returns the status
+// and body of the response.
+func (s *Server) GetBody(path string) (int, []byte, error) {
+	resp, err := s.Get(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, b, nil
+}
@@ -0,0 +1,58 @@
+package minicachetest
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lllamnyp/minicache"
+)
+
+func TestServer(t *testing.T) {
+	var calls int32
+	c := minicache.New(minicache.WithDefaultTTL(time.Hour))
+	defer c.Close()
+	if err := c.Register("/users/:id", func(p []string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte("user " + p[1]), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterStatus("/ping", http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(c)
+	defer s.Close()
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/users/1", http.StatusOK, "user 1"},
+		{"/users/1", http.StatusOK, "user 1"},
+		{"/users/2", http.StatusOK, "user 2"},
+		{"/ping", http.StatusNoContent, ""},
+		{"/missing/route/here", http.StatusNotFound, "no route matches /missing/route/here"},
+	}
+	for _, tt := range tests {
+		status, body, err := s.GetBody(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.wantStatus || string(body) != tt.wantBody {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.path, status, body, tt.wantStatus, tt.wantBody)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("handler called %d times, want 2 as /users/1 is cached", n)
+	}
+	resp, err := s.Get("/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Age") == "" {
+		t.Error("response did not come from the cache")
+	}
+}
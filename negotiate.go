@@ -0,0 +1,70 @@
+package minicache
+
+import (
+	"strconv"
+	"strings"
+)
+
+type mediaRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+func parseAccept(accept string) []mediaRange {
+	ranges := make([]mediaRange, 0, 4)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok || typ == "" || subtype == "" {
+			continue
+		}
+		mr := mediaRange{typ: typ, subtype: subtype, q: 1}
+		for _, p := range params[1:] {
+			name, value, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				mr.q = q
+			}
+		}
+		ranges = append(ranges, mr)
+	}
+	return ranges
+}
+
+// negotiate picks the offer with the highest quality in the Accept header.
+// For each offer the most specific matching media range decides its quality,
+// and ties are broken by the order of offers. A missing Accept header accepts
+// the first offer.
+func negotiate(accept string, offers []string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(strings.ToLower(offer), "/")
+		subtype, _, _ = strings.Cut(subtype, ";")
+		specificity, q := -1, 0.0
+		for _, mr := range ranges {
+			s := -1
+			switch {
+			case mr.typ == typ && mr.subtype == strings.TrimSpace(subtype):
+				s = 2
+			case mr.typ == typ && mr.subtype == "*":
+				s = 1
+			case mr.typ == "*" && mr.subtype == "*":
+				s = 0
+			}
+			if s > specificity {
+				specificity, q = s, mr.q
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
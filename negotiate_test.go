@@ -0,0 +1,62 @@
+package minicache
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcceptVariants(t *testing.T) {
+	tests := []struct {
+		name        string
+		accepts     []string
+		wantTypes   []string
+		wantEntries int
+	}{
+		{"one entry per representation", []string{"application/json", "application/xml", "application/json"}, []string{"application/json", "application/xml", "application/json"}, 2},
+		{"missing Accept gets the first", []string{"", "application/json"}, []string{"application/json", "application/json"}, 1},
+		{"quality decides", []string{"application/json;q=0.5, application/xml"}, []string{"application/xml"}, 1},
+		{"wildcard", []string{"*/*", "application/*;q=0.1, application/xml"}, []string{"application/json", "application/xml"}, 2},
+		{"nothing acceptable", []string{"text/html", "image/*"}, []string{"", ""}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := New(WithDefaultTTL(time.Hour))
+			err := c.RegisterResponse("/doc", func(ctx context.Context, _ []string) (*Response, error) {
+				atomic.AddInt32(&calls, 1)
+				return &Response{Body: []byte(MediaTypeFromContext(ctx))}, nil
+			}, WithAcceptVariants("application/json", "application/xml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, accept := range tt.accepts {
+				w := serve(t, c, http.MethodGet, "/doc", "Accept", accept)
+				if got := w.Header().Get("Vary"); got != "Accept" {
+					t.Errorf("Vary = %q, want Accept", got)
+				}
+				want := tt.wantTypes[i]
+				if want == "" {
+					if w.Code != http.StatusNotAcceptable {
+						t.Errorf("Accept %q: status = %d, want 406", accept, w.Code)
+					}
+					continue
+				}
+				if got := body(t, w); w.Code != http.StatusOK || got != want {
+					t.Errorf("Accept %q: got %d %q, want %q", accept, w.Code, got, want)
+				}
+				if got := w.Header().Get("Content-Type"); got != want {
+					t.Errorf("Accept %q: Content-Type = %q, want %q", accept, got, want)
+				}
+			}
+			c.RLock()
+			entries := len(c.cache)
+			c.RUnlock()
+			if n := int(atomic.LoadInt32(&calls)); entries != tt.wantEntries || n != tt.wantEntries {
+				t.Errorf("%d entries cached by %d calls, want %d", entries, n, tt.wantEntries)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package minicache
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// partition holds the keys of entries counted against the same limits. The
+// entries of routes registered without WithPartition share the default
+// partition, limited by WithMaxEntries.
+type partition struct {
+	maxEntries int
+	maxBytes   int64
+	// policy is nil for a partition without limits, which then tracks no
+	// keys.
+	policy EvictionPolicy
+	sizes  map[string]int64
+	bytes  int64
+}
+
+// WithPartitionLimit declares the partition name, which keeps the entries of
+// routes registered with WithPartition(name) apart from all others. Its
+// least recently used entries are evicted to stay within maxEntries entries
+// and maxBytes bytes of values, a zero meaning no limit, without evicting
+// entries of other partitions.
+func WithPartitionLimit(name string, maxEntries int, maxBytes int64) OptionFunc {
+	return func(c *cache) error {
+		if name == "" {
+			return errors.New("partition name must not be empty")
+		}
+		if maxEntries < 0 || maxBytes < 0 {
+			return errors.New("partition limits must not be negative")
+		}
+		if c.partitions == nil {
+			c.partitions = make(map[string]*partition)
+		}
+		c.partitions[name] = &partition{maxEntries: maxEntries, maxBytes: maxBytes, policy: NewLRU(), sizes: make(map[string]int64)}
+		return nil
+	}
+}
+
+// WithPartition keeps the route's entries in the partition name, declared
+// with WithPartitionLimit.
+func WithPartition(name string) RouteOptionFunc {
+	return func(r *route) error {
+		r.partition = name
+		return nil
+	}
+}
+
+// WithMaxDynamicCardinality bounds the entries of the route, such as one per
+// distinct id for "/users/:id", to n, evicting its oldest entry to make room
+// for a new one. Entries of other routes are never evicted for it. Each
+// variant of a value, such as by Accept, counts as an entry of its own.
+func WithMaxDynamicCardinality(n int) RouteOptionFunc {
+	return func(r *route) error {
+		if n < 1 {
+			return errors.New("maximum dynamic cardinality must be positive")
+		}
+		if r.cardinality == nil || r.cardinality.maxEntries != n {
+			r.cardinality = &partition{maxEntries: n, policy: NewFIFO(), sizes: make(map[string]int64)}
+		}
+		return nil
+	}
+}
+
+func (c *cache) routePartition(r *route) *partition {
+	if r.cardinality != nil {
+		return r.cardinality
+	}
+	if p, ok := c.partitions[r.partition]; ok {
+		return p
+	}
+	return c.defaultPartition
+}
+
+// keyPartition returns the partition of the route that the entry for key
+// was cached for, as far as the key tells: the route named by a key made
+// with WithKeySegments, or else the route matching the path of the key.
+func (c *cache) keyPartition(key string) *partition {
+	path, query, _ := strings.Cut(key, "?")
+	if values, err := url.ParseQuery(query); err == nil && values.Get("route") != "" {
+		if segments, err := c.parsePath(values.Get("route")); err == nil {
+			var p *partition
+			c.routesMu.RLock()
+			if r := c.root.find(segments); r != nil && r.handler != nil {
+				p = c.routePartition(r)
+			}
+			c.routesMu.RUnlock()
+			if p != nil {
+				return p
+			}
+		}
+	}
+	if segments, err := c.parsePath(path); err == nil {
+		if r, _ := c.lookup(segments); r != nil {
+			return c.routePartition(r)
+		}
+	}
+	return c.defaultPartition
+}
+
+func (p *partition) record(key string, size int64) {
+	if p.policy == nil {
+		return
+	}
+	p.bytes += size - p.sizes[key]
+	p.sizes[key] = size
+	p.policy.RecordAccess(key)
+}
+
+func (p *partition) forget(key string) {
+	if p.policy == nil {
+		return
+	}
+	p.bytes -= p.sizes[key]
+	delete(p.sizes, key)
+	p.policy.Remove(key)
+}
+
+func (p *partition) full() bool {
+	return p.maxEntries > 0 && len(p.sizes) >= p.maxEntries
+}
+
+func (p *partition) oversized() bool {
+	return p.maxBytes > 0 && p.bytes > p.maxBytes
+}
@@ -0,0 +1,125 @@
+package minicache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPartitions(t *testing.T) {
+	register := func(t *testing.T, c *cache, pattern string, options ...RouteOptionFunc) {
+		t.Helper()
+		if err := c.Register(pattern, func(p []string) ([]byte, error) {
+			return []byte(p[len(p)-1]), nil
+		}, options...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		options  []OptionFunc
+		routes   func(t *testing.T, c *cache)
+		requests []string
+		cached   []string
+		evicted  []string
+	}{
+		{
+			name:    "entry limit",
+			options: []OptionFunc{WithMaxEntries(3), WithPartitionLimit("noisy", 2, 0)},
+			routes: func(t *testing.T, c *cache) {
+				register(t, c, "/hot/:id")
+				register(t, c, "/noisy/:id", WithPartition("noisy"))
+			},
+			requests: []string{"/hot/1", "/hot/2", "/hot/3", "/noisy/1", "/noisy/2", "/noisy/3", "/noisy/4"},
+			cached:   []string{"/hot/1", "/hot/2", "/hot/3", "/noisy/3", "/noisy/4"},
+			evicted:  []string{"/noisy/1", "/noisy/2"},
+		},
+		{
+			name:    "byte limit",
+			options: []OptionFunc{WithPartitionLimit("big", 0, 10)},
+			routes: func(t *testing.T, c *cache) {
+				register(t, c, "/hot/:id")
+				register(t, c, "/big/:id", WithPartition("big"))
+			},
+			requests: []string{"/hot/1", "/big/aaaa", "/big/bbbb", "/big/cccc"},
+			cached:   []string{"/hot/1", "/big/bbbb", "/big/cccc"},
+			evicted:  []string{"/big/aaaa"},
+		},
+		{
+			name:    "default partition limit",
+			options: []OptionFunc{WithMaxEntries(1), WithPartitionLimit("p", 2, 0)},
+			routes: func(t *testing.T, c *cache) {
+				register(t, c, "/hot/:id")
+				register(t, c, "/p/:id", WithPartition("p"))
+			},
+			requests: []string{"/p/1", "/p/2", "/hot/1", "/hot/2"},
+			cached:   []string{"/p/1", "/p/2", "/hot/2"},
+			evicted:  []string{"/hot/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			tt.routes(t, c)
+			for _, path := range tt.requests {
+				serve(t, c, http.MethodGet, path)
+			}
+			c.RLock()
+			defer c.RUnlock()
+			for _, key := range tt.cached {
+				if _, ok := c.cache[key]; !ok {
+					t.Errorf("%s was evicted", key)
+				}
+			}
+			for _, key := range tt.evicted {
+				if _, ok := c.cache[key]; ok {
+					t.Errorf("%s was not evicted", key)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxDynamicCardinality(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []RouteOptionFunc
+		requests [][2]string
+		want     int
+		evicted  string
+	}{
+		{"within the limit", nil, [][2]string{{"/users/1", ""}, {"/users/2", ""}}, 2, ""},
+		{"oldest value evicted", nil, [][2]string{{"/users/1", ""}, {"/users/2", ""}, {"/users/1", ""}, {"/users/3", ""}}, 2, "/users/1"},
+		{"variants count", []RouteOptionFunc{WithAcceptVariants("application/json", "application/xml")}, [][2]string{{"/users/1", "application/json"}, {"/users/1", "application/xml"}, {"/users/2", "application/json"}}, 2, "/users/1?accept=application%2Fjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithDefaultTTL(time.Hour))
+			if err := c.Register("/users/:id", constant("user"), append(tt.options, WithMaxDynamicCardinality(2))...); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Register("/other/:id", constant("other")); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/other/1")
+			for _, r := range tt.requests {
+				if w := serve(t, c, http.MethodGet, r[0], "Accept", r[1]); w.Code != http.StatusOK || body(t, w) != "user" {
+					t.Errorf("GET %s = %d %q, want user", r[0], w.Code, body(t, w))
+				}
+			}
+			c.RLock()
+			defer c.RUnlock()
+			if _, ok := c.cache["/other/1"]; !ok {
+				t.Error("an entry of another route was evicted")
+			}
+			if got := len(c.cache) - 1; got != tt.want {
+				t.Errorf("route holds %d entries, want %d: %v", got, tt.want, c.cache)
+			}
+			if tt.evicted != "" {
+				if _, ok := c.cache[tt.evicted]; ok {
+					t.Errorf("%s was not evicted", tt.evicted)
+				}
+			}
+		})
+	}
+}
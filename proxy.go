@@ -0,0 +1,146 @@
+package minicache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxiedHeaders are the upstream response headers kept by RegisterProxy.
+var proxiedHeaders = []string{"Content-Type", "Cache-Control", "Expires", "Last-Modified", "ETag"}
+
+// defaultProxyClient fetches upstreams for RegisterProxy without
+// WithProxyClient, so that a stalled upstream cannot hold a fill forever.
+var defaultProxyClient = &http.Client{Timeout: 30 * time.Second}
+
+// WithProxyClient sets the client RegisterProxy fetches upstreams with, in
+// place of one that times out after 30 seconds.
+func WithProxyClient(client *http.Client) OptionFunc {
+	return func(c *cache) error {
+		if client == nil {
+			return errors.New("proxy client must not be nil")
+		}
+		c.proxyClient = client
+		return nil
+	}
+}
+
+// RegisterProxy registers a handler that fetches upstreamURL with GET and
+// caches its response. Placeholders such as {id} in upstreamURL are replaced
+// by the path parameters of the same name, so "/users/:id" may be proxied to
+// "https://api.example.com/users/{id}". Renewals are conditional on the
+// upstream ETag or Last-Modified, and a 404 or 410 upstream is not found.
+// Only 200 and 203 responses are cached, for as long as their Cache-Control
+// max-age or Expires header allows, or the route TTL without either.
+// Responses marked no-store, private or no-cache are passed through without
+// being cached.
+func (c *cache) RegisterProxy(path string, upstreamURL string, options ...RouteOptionFunc) error {
+	if _, err := url.Parse(upstreamURL); err != nil {
+		return fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	return c.RegisterResponse(path, func(ctx context.Context, _ []string) (*Response, error) {
+		params := ParamsFromContext(ctx)
+		pairs := make([]string, 0, 2*len(params))
+		for name, value := range params {
+			pairs = append(pairs, "{"+name+"}", url.PathEscape(value))
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.NewReplacer(pairs...).Replace(upstreamURL), nil)
+		if err != nil {
+			return nil, err
+		}
+		if prev, _ := ctx.Value(previousKey).(entryData); prev.header != nil {
+			if etag := prev.header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if modified := prev.header.Get("Last-Modified"); modified != "" {
+				req.Header.Set("If-Modified-Since", modified)
+			}
+		}
+		client := c.proxyClient
+		if client == nil {
+			client = defaultProxyClient
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNonAuthoritativeInfo:
+		case http.StatusNotModified:
+			return &Response{TTL: c.upstreamTTL(resp.Header)}, ErrNotModified
+		case http.StatusNotFound, http.StatusGone:
+			return nil, ErrNotFound
+		default:
+			return nil, fmt.Errorf("upstream %s: %s", req.URL.Redacted(), resp.Status)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		header := make(http.Header)
+		for _, name := range proxiedHeaders {
+			if vs := resp.Header.Values(name); len(vs) > 0 {
+				header[http.CanonicalHeaderKey(name)] = vs
+			}
+		}
+		directives := cacheDirectives(resp.Header)
+		_, noStore := directives["no-store"]
+		_, private := directives["private"]
+		_, noCache := directives["no-cache"]
+		return &Response{
+			Body:    body,
+			Header:  header,
+			Status:  resp.StatusCode,
+			NoStore: noStore || private || noCache,
+			TTL:     c.upstreamTTL(resp.Header),
+		}, nil
+	}, options...)
+}
+
+// upstreamTTL returns how long an upstream response with header may be
+// cached by a shared cache, or zero if its headers do not say. A response
+// that is stale already gets the shortest TTL, as zero would mean the route
+// TTL.
+func (c *cache) upstreamTTL(header http.Header) time.Duration {
+	directives := cacheDirectives(header)
+	ttl, known := time.Duration(0), false
+	for _, v := range []string{directives["max-age"], directives["s-maxage"]} {
+		if seconds, err := strconv.ParseInt(strings.Trim(v, `"`), 10, 64); err == nil {
+			ttl, known = time.Duration(seconds)*time.Second, true
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil && !known {
+		now := c.now()
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		ttl, known = expires.Sub(now), true
+	}
+	if known && ttl <= 0 {
+		return time.Nanosecond
+	}
+	return ttl
+}
+
+// cacheDirectives returns the values of the Cache-Control directives in
+// header by their lower case names, with an empty value for a directive
+// without one.
+func cacheDirectives(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = value
+			}
+		}
+	}
+	return directives
+}
@@ -0,0 +1,114 @@
+package minicache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTTL(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(WithClock(func() time.Time { return now }))
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"none", http.Header{}, 0},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute},
+		{"s-maxage wins", http.Header{"Cache-Control": {"s-maxage=120, max-age=60"}}, 2 * time.Minute},
+		{"max-age over Expires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Minute},
+		{"Expires", http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"Expires from Date", http.Header{"Date": {now.Add(-time.Hour).Format(http.TimeFormat)}, "Expires": {now.Format(http.TimeFormat)}}, time.Hour},
+		{"stale", http.Header{"Cache-Control": {"max-age=0"}}, time.Nanosecond},
+		{"expired", http.Header{"Expires": {now.Add(-time.Hour).Format(http.TimeFormat)}}, time.Nanosecond},
+		{"invalid max-age", http.Header{"Cache-Control": {"max-age=soon"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.upstreamTTL(tt.header); got != tt.want {
+				t.Errorf("upstreamTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterProxy(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		cacheControl string
+		wantStatus   int
+		wantCached   bool
+	}{
+		{"ok", http.StatusOK, "max-age=300", http.StatusOK, true},
+		{"non-authoritative", http.StatusNonAuthoritativeInfo, "max-age=300", http.StatusNonAuthoritativeInfo, true},
+		{"public", http.StatusOK, "public, max-age=300", http.StatusOK, true},
+		{"no-store", http.StatusOK, "no-store", http.StatusOK, false},
+		{"private", http.StatusOK, "private, max-age=300", http.StatusOK, false},
+		{"private field", http.StatusOK, `max-age=300, private="Set-Cookie"`, http.StatusOK, false},
+		{"no-cache", http.StatusOK, "No-Cache, max-age=300", http.StatusOK, false},
+		{"created", http.StatusCreated, "max-age=300", http.StatusInternalServerError, false},
+		{"partial content", http.StatusPartialContent, "max-age=300", http.StatusInternalServerError, false},
+		{"not found", http.StatusNotFound, "max-age=300", http.StatusNotFound, false},
+		{"server error", http.StatusBadGateway, "max-age=300", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(r.URL.Path))
+			}))
+			defer upstream.Close()
+			now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			c := New(WithDefaultTTL(time.Minute), WithClock(func() time.Time { return now }))
+			defer c.Close()
+			if err := c.RegisterProxy("/users/:id", upstream.URL+"/u/{id}"); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, "/users/a%20b")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			c.RLock()
+			_, cached := c.cache["/users/a%20b"]
+			c.RUnlock()
+			if cached != tt.wantCached {
+				t.Fatalf("cached = %v, want %v", cached, tt.wantCached)
+			}
+			if w.Code == http.StatusOK && body(t, w) != "/u/a b" {
+				t.Errorf("body = %q", body(t, w))
+			}
+			if got := w.Header().Get("Cache-Control"); w.Code == http.StatusOK && got != tt.cacheControl {
+				t.Errorf("Cache-Control = %q, want the upstream %q", got, tt.cacheControl)
+			}
+			if cached {
+				if got := expiry(t, c, "/users/a%20b", now); got != 5*time.Minute {
+					t.Errorf("expires in %v, want the upstream max-age", got)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyClientTimeout(t *testing.T) {
+	if defaultProxyClient.Timeout <= 0 {
+		t.Error("the default proxy client has no timeout")
+	}
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+	c := New(WithProxyClient(&http.Client{Timeout: 20 * time.Millisecond}))
+	defer c.Close()
+	if err := c.RegisterProxy("/a", upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(t, c, http.MethodGet, "/a"); w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500 once the client times out", w.Code)
+	}
+}
@@ -0,0 +1,198 @@
+package minicache
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrNotModified may be returned by a handler during renewal when the
+// content identified by VersionFromContext has not changed. The cached value
+// is then kept and only its expiry is extended.
+var ErrNotModified = errors.New("not modified")
+
+type Response struct {
+	Body []byte
+	// Header is sent with every response served from the entry. Repeated
+	// headers such as Set-Cookie keep all their values, each sent as a
+	// header line of its own.
+	Header http.Header
+	Status int
+	Tags   []string
+	// Stream, if set, is read in place of Body and closed by the cache. It
+	// is passed through to the client as it arrives where possible, and
+	// only cached if it could be read to the end.
+	Stream io.ReadCloser
+	// Vary names request headers the response depends on. Once a fill
+	// reports them, requests for the same key are cached separately by the
+	// values of these headers, starting with the request that ran the fill.
+	Vary []string
+	// VariantKey files the entry under its key combined with VariantKey,
+	// for a response that depends on something only the handler can see,
+	// such as a feature flag. As that is only known once the handler has
+	// run, requests for the key are served the entry of the variant key
+	// reported last, and a renewal reporting another one moves the entry.
+	VariantKey string
+	// NoStore serves the response without caching it, as for an upstream
+	// response that a shared cache must not store.
+	NoStore bool
+	// TTL, if positive, is how long the entry is kept fresh, in place of
+	// the TTL of the route or from WithTTLFunc, as derived for example from
+	// an upstream Cache-Control max-age. It also extends the entry when
+	// returned along with ErrNotModified.
+	TTL time.Duration
+}
+
+type ResponseHandlerFunc func(ctx context.Context, path []string) (*Response, error)
+
+type CachePolicyFunc func(r *http.Request, path []string, resp *Response) bool
+
+func WithCachePolicy(policy CachePolicyFunc) OptionFunc {
+	return func(c *cache) error {
+		c.policy = policy
+		return nil
+	}
+}
+
+func (c *cache) cacheable(r *http.Request, path []string, resp *Response) bool {
+	return !resp.NoStore && (c.policy == nil || c.policy(r, path, resp))
+}
+
+type entryData struct {
+	value    []byte
+	header   http.Header
+	status   int
+	etag     string
+	fetched  time.Time
+	modified time.Time
+	expiry   time.Time
+	// noStore marks data that is served but was not kept in the cache.
+	noStore bool
+	// purged marks data expired by a soft Purge.
+	purged bool
+	// identity caches the decompressed value of gzipped data.
+	identity *identityBody
+	// stream is set instead of value on data returned to the request that
+	// is streaming a fill.
+	stream io.ReadCloser
+}
+
+func (c *cache) newEntryData(resp *Response, ttl time.Duration) entryData {
+	now := c.now()
+	e := entryData{fetched: now, modified: now, expiry: now.Add(c.clampTTL(ttl))}
+	if resp != nil {
+		e.value = resp.Body
+		e.header = resp.Header.Clone()
+		e.status = resp.Status
+		if e.status == 0 {
+			e.status = http.StatusOK
+		}
+		e.etag = c.etag(e.value)
+	}
+	return e.withIdentity()
+}
+
+func (c *cache) etag(b []byte) string {
+	h := c.newHash()
+	h.Write(b)
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// defaultMaxStreamedBody is how much of a streamed response is read for
+// caching without WithMaxStreamedBody.
+const defaultMaxStreamedBody = 64 << 20
+
+// errBodyTooLarge fails fills whose streamed response is too large to cache.
+var errBodyTooLarge = errors.New("streamed response is too large to cache")
+
+// WithMaxStreamedBody limits how much of a streamed response is read into
+// the cache, 64 MiB by default. A larger response is still passed through
+// to the client streaming it, but it is not cached, and other requests
+// waiting for it fail. It also limits how large a gzipped body may grow when
+// decompressed for a client that does not accept gzip.
+func WithMaxStreamedBody(n int64) OptionFunc {
+	return func(c *cache) error {
+		if n < 1 {
+			return errors.New("maximum streamed body must be positive")
+		}
+		c.maxStreamedBody = n
+		return nil
+	}
+}
+
+func (c *cache) streamLimit() int64 {
+	if c.maxStreamedBody > 0 {
+		return c.maxStreamedBody
+	}
+	return defaultMaxStreamedBody
+}
+
+// readStream reads r whole, failing with errBodyTooLarge past max bytes.
+func readStream(r io.ReadCloser, max int64) ([]byte, error) {
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err == nil && int64(len(b)) > max {
+		return nil, errBodyTooLarge
+	}
+	return b, err
+}
+
+// streamBody tees a streamed response into a buffer as it is read, and hands
+// the result to done once the stream ends. Past max bytes, it stops
+// buffering and fails with errBodyTooLarge once the stream ends.
+type streamBody struct {
+	src      io.ReadCloser
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+	done     func(body []byte, err error)
+	finished bool
+}
+
+func (s *streamBody) Read(p []byte) (int, error) {
+	if s.finished {
+		return 0, io.EOF
+	}
+	n, err := s.src.Read(p)
+	if !s.overflow && int64(s.buf.Len()+n) > s.max {
+		s.overflow = true
+		s.buf = bytes.Buffer{}
+	}
+	if !s.overflow {
+		s.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		s.finish(nil)
+	} else if err != nil {
+		s.finish(err)
+	}
+	return n, err
+}
+
+// Close reads whatever the client did not, up to max bytes, so the entry is
+// still populated if writing to the client failed.
+func (s *streamBody) Close() error {
+	if !s.finished {
+		var err error
+		if !s.overflow {
+			_, err = io.Copy(&s.buf, io.LimitReader(s.src, s.max-int64(s.buf.Len())+1))
+			s.overflow = int64(s.buf.Len()) > s.max
+		}
+		s.finish(err)
+	}
+	return nil
+}
+
+func (s *streamBody) finish(err error) {
+	s.finished = true
+	s.src.Close()
+	if s.overflow {
+		s.done(nil, errBodyTooLarge)
+		return
+	}
+	s.done(s.buf.Bytes(), err)
+}
@@ -0,0 +1,323 @@
+package minicache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingReader yields n bytes, counting how many were read.
+type countingReader struct {
+	n, read int64
+	closed  bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.read >= r.n {
+		return 0, io.EOF
+	}
+	if left := r.n - r.read; int64(len(p)) > left {
+		p = p[:left]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func (r *countingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestStreamBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int64
+		read    int64
+		wantErr error
+	}{
+		{"read whole", 10, 10, nil},
+		{"closed early", 10, 3, nil},
+		{"at the limit", 16, 16, nil},
+		{"read past the limit", 100, 100, errBodyTooLarge},
+		{"closed before the limit", 1 << 30, 4, errBodyTooLarge},
+		{"closed past the limit", 1 << 30, 40, errBodyTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &countingReader{n: tt.size}
+			var got []byte
+			var gotErr error
+			calls := 0
+			s := &streamBody{src: src, max: 16, done: func(body []byte, err error) {
+				calls++
+				got, gotErr = body, err
+			}}
+			n, err := io.Copy(io.Discard, io.LimitReader(s, tt.read))
+			if err != nil || n != tt.read {
+				t.Fatalf("read %d bytes, %v", n, err)
+			}
+			s.Close()
+			if calls != 1 || !src.closed {
+				t.Fatalf("done called %d times, source closed %v", calls, src.closed)
+			}
+			if !errors.Is(gotErr, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", gotErr, tt.wantErr)
+			}
+			if tt.wantErr == nil && int64(len(got)) != tt.size {
+				t.Errorf("buffered %d bytes, want %d", len(got), tt.size)
+			}
+			if limit := int64(17); src.read > limit && src.read > tt.read {
+				t.Errorf("read %d bytes of the source, past the limit", src.read)
+			}
+		})
+	}
+}
+
+func TestStreamedBodyTooLarge(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantCached bool
+	}{
+		{"small", 8, true},
+		{"large", 64, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithMaxStreamedBody(16))
+			want := strings.Repeat("x", tt.size)
+			if err := c.RegisterResponse("/s", func(context.Context, []string) (*Response, error) {
+				return &Response{Stream: io.NopCloser(bytes.NewReader([]byte(want)))}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, "/s")
+			if got := body(t, w); w.Code != http.StatusOK || got != want {
+				t.Errorf("got %d with %d bytes, want the whole body", w.Code, len(got))
+			}
+			c.RLock()
+			_, cached := c.cache["/s"]
+			c.RUnlock()
+			if cached != tt.wantCached {
+				t.Errorf("cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	small := func(_ *http.Request, _ []string, resp *Response) bool {
+		return len(resp.Body) <= 4
+	}
+	tests := []struct {
+		name       string
+		value      string
+		wantCached bool
+	}{
+		{"under the threshold", "abc", true},
+		{"at the threshold", "abcd", true},
+		{"over the threshold", "abcde", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			c := New(WithCachePolicy(small), WithDefaultTTL(time.Hour))
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				calls++
+				return []byte(tt.value), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if got := body(t, serve(t, c, http.MethodGet, "/a")); got != tt.value {
+					t.Errorf("GET = %q, want %q", got, tt.value)
+				}
+			}
+			c.RLock()
+			_, cached := c.cache["/a"]
+			c.RUnlock()
+			if cached != tt.wantCached {
+				t.Errorf("cached = %v, want %v", cached, tt.wantCached)
+			}
+			if want := map[bool]int{true: 1, false: 2}[tt.wantCached]; calls != want {
+				t.Errorf("handler called %d times, want %d", calls, want)
+			}
+		})
+	}
+}
+
+func TestNotModifiedKeepsValue(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *Response
+		want time.Duration
+	}{
+		{"route TTL", nil, time.Minute},
+		{"response TTL", &Response{TTL: time.Hour}, time.Hour},
+		{"with a body", &Response{Body: []byte("ignored")}, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			clock := func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+			c := New(WithDefaultTTL(time.Minute), WithClock(clock), WithoutBackgroundRenewal())
+			var versions []string
+			if err := c.RegisterResponse("/a", func(ctx context.Context, _ []string) (*Response, error) {
+				versions = append(versions, VersionFromContext(ctx))
+				if len(versions) == 1 {
+					return &Response{Body: []byte("original")}, nil
+				}
+				return tt.resp, ErrNotModified
+			}); err != nil {
+				t.Fatal(err)
+			}
+			first := serve(t, c, http.MethodGet, "/a")
+			etag := first.Header().Get("ETag")
+			c.RLock()
+			entry := c.cache["/a"]
+			c.RUnlock()
+			entry.RLock()
+			value, fetched := entry.value, entry.fetched
+			entry.RUnlock()
+			for i := 0; i < 2; i++ {
+				mu.Lock()
+				now = now.Add(2 * time.Hour)
+				mu.Unlock()
+				w := serve(t, c, http.MethodGet, "/a")
+				if got := body(t, w); got != "original" {
+					t.Errorf("GET after renewal = %q, want the kept value", got)
+				}
+				if got := w.Header().Get("ETag"); got != etag {
+					t.Errorf("ETag = %q, want the kept %q", got, etag)
+				}
+				if got := expiry(t, c, "/a", clock()); got != tt.want {
+					t.Errorf("expires in %v, want %v", got, tt.want)
+				}
+			}
+			entry.RLock()
+			defer entry.RUnlock()
+			if &entry.value[0] != &value[0] {
+				t.Error("the cached bytes were replaced")
+			}
+			if !entry.fetched.After(fetched) {
+				t.Error("the renewal was not recorded")
+			}
+			if len(versions) != 3 || versions[1] != etag || versions[2] != etag {
+				t.Errorf("handler saw versions %q, want the ETag %q on renewals", versions, etag)
+			}
+		})
+	}
+}
+
+func TestHashFunc(t *testing.T) {
+	t.Run("nil", func(t *testing.T) {
+		if err := WithHashFunc(nil)(&cache{}); err == nil {
+			t.Error("WithHashFunc(nil) succeeded")
+		}
+	})
+	tests := []struct {
+		name    string
+		newHash func() hash.Hash
+	}{
+		{"default", sha256.New},
+		{"fnv", func() hash.Hash { return fnv.New64a() }},
+		{"crc32", func() hash.Hash { return crc32.NewIEEE() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etags := func() (a, b string) {
+				var options []OptionFunc
+				if tt.name != "default" {
+					options = append(options, WithHashFunc(tt.newHash))
+				}
+				c := New(options...)
+				for path, value := range map[string]string{"/a": "a", "/b": "b"} {
+					if err := c.Register(path, constant(value)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return serve(t, c, http.MethodGet, "/a").Header().Get("ETag"), serve(t, c, http.MethodGet, "/b").Header().Get("ETag")
+			}
+			a, b := etags()
+			again, _ := etags()
+			h := tt.newHash()
+			h.Write([]byte("a"))
+			if want := `"` + hex.EncodeToString(h.Sum(nil)) + `"`; a != want {
+				t.Errorf("ETag = %s, want %s", a, want)
+			}
+			if a != again {
+				t.Errorf("ETag changed from %s to %s for the same payload", a, again)
+			}
+			if a == b {
+				t.Errorf("distinct payloads share ETag %s", a)
+			}
+		})
+	}
+}
+
+func TestStreamReachesClientBeforeCompletion(t *testing.T) {
+	chunks := []string{"first\n", "second\n", "third\n"}
+	pr, pw := io.Pipe()
+	c := New(WithDefaultTTL(time.Hour))
+	if err := c.RegisterResponse("/events", func(context.Context, []string) (*Response, error) {
+		return &Response{Stream: pr}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	url := start(t, c) + "/events"
+	// The headers only go out with the first chunk.
+	go pw.Write([]byte(chunks[0]))
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for i, chunk := range chunks {
+		if i > 0 {
+			if _, err := pw.Write([]byte(chunk)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := make(chan string, 1)
+		go func() {
+			b := make([]byte, len(chunk))
+			n, _ := io.ReadFull(resp.Body, b)
+			got <- string(b[:n])
+		}()
+		select {
+		case g := <-got:
+			if g != chunk {
+				t.Fatalf("read %q, want %q", g, chunk)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q never reached the client while the handler was still streaming", chunk)
+		}
+	}
+	pw.Close()
+	if rest, _ := io.ReadAll(resp.Body); len(rest) != 0 {
+		t.Errorf("read %q after the stream ended", rest)
+	}
+	settled(t, c, "/events")
+	if got, want := body(t, serve(t, c, http.MethodGet, "/events")), strings.Join(chunks, ""); got != want {
+		t.Errorf("cached body = %q, want %q", got, want)
+	}
+}
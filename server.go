@@ -0,0 +1,210 @@
+package minicache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func (c *cache) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := c.listen(addr)
+	if err != nil {
+		return err
+	}
+	return c.Serve(l)
+}
+
+// WithBindRetry makes ListenAndServe retry up to attempts more times while
+// the address is in use, waiting a jittered backoff that doubles every time.
+func WithBindRetry(attempts int, backoff time.Duration) OptionFunc {
+	return func(c *cache) error {
+		if attempts < 1 || backoff <= 0 {
+			return errors.New("bind retry needs positive attempts and backoff")
+		}
+		c.bindAttempts, c.bindBackoff = attempts, backoff
+		return nil
+	}
+}
+
+func (c *cache) listen(addr string) (net.Listener, error) {
+	backoff := c.bindBackoff
+	for attempt := 0; ; attempt++ {
+		l, err := net.Listen("tcp", addr)
+		if err == nil || attempt >= c.bindAttempts || !addrInUse(err) {
+			return l, err
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		c.l.Info("address in use, retrying", "address", addr, "attempt", attempt+1, "wait", wait.String())
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-c.ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// wsaeaddrinuse is the error Windows fails to bind an address in use with,
+// which syscall.EADDRINUSE does not match there.
+const wsaeaddrinuse = syscall.Errno(10048)
+
+func addrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || runtime.GOOS == "windows" && errors.Is(err, wsaeaddrinuse)
+}
+
+func (c *cache) Serve(l net.Listener) error {
+	srv := &http.Server{}
+	srv.Addr = l.Addr().String()
+	srv.Handler = c
+	srv.WriteTimeout = c.writeTimeout
+	srv.IdleTimeout = c.idleTimeout
+	srv.SetKeepAlivesEnabled(!c.disableKeepAlives)
+	if c.h2c {
+		srv.Handler = h2c.NewHandler(c, &http2.Server{})
+	}
+	if c.maxConnections > 0 {
+		l = &limitListener{Listener: l, sem: make(chan struct{}, c.maxConnections)}
+		srv.ConnContext = rejectedConnContext
+		srv.Handler = c.rejectOverLimit(srv.Handler)
+	}
+	c.srvMu.Lock()
+	c.srv = srv
+	c.srvMu.Unlock()
+	return srv.Serve(l)
+}
+
+// errTooManyConnections answers requests on connections past the limit set
+// with WithMaxConnections.
+var errTooManyConnections = errors.New("too many connections")
+
+// limitListener accepts every connection, but marks those past the capacity
+// of sem as rejected, so that their requests can be answered before they are
+// closed rather than left waiting to be accepted.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return &limitedConn{Conn: conn, release: func() { <-l.sem }}, nil
+	default:
+		return &limitedConn{Conn: conn, rejected: true}, nil
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	rejected bool
+	release  func()
+	once     sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	if c.release != nil {
+		c.once.Do(c.release)
+	}
+	return c.Conn.Close()
+}
+
+func rejectedConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if lc, ok := conn.(*limitedConn); ok && lc.rejected {
+		return context.WithValue(ctx, rejectedConnKey, true)
+	}
+	return ctx
+}
+
+// rejectOverLimit answers requests on rejected connections as overloaded,
+// and the others with h.
+func (c *cache) rejectOverLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(rejectedConnKey) == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Connection", "close")
+		c.overloaded(w, r, errTooManyConnections)
+	})
+}
+
+// Shutdown stops the server started by Serve and waits for in-flight
+// requests, including those waiting on fills and renewals, to finish before
+// closing the cache. It gives up waiting, for the requests or for background
+// work to stop, when ctx is done.
+func (c *cache) Shutdown(ctx context.Context) error {
+	c.srvMu.Lock()
+	srv := c.srv
+	c.srvMu.Unlock()
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+	select {
+	case <-c.drain():
+	case <-ctx.Done():
+	}
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+func (c *cache) enter() {
+	c.inflightMu.Lock()
+	c.inflight++
+	c.inflightMu.Unlock()
+}
+
+func (c *cache) leave() {
+	c.inflightMu.Lock()
+	c.inflight--
+	if c.inflight == 0 && c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+	c.inflightMu.Unlock()
+}
+
+// drain returns a channel that is closed once no request is in flight.
+func (c *cache) drain() <-chan struct{} {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	if c.drained != nil {
+		return c.drained
+	}
+	ch := make(chan struct{})
+	if c.inflight == 0 {
+		close(ch)
+	} else {
+		c.drained = ch
+	}
+	return ch
+}
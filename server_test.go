@@ -0,0 +1,315 @@
+package minicache
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestBindRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		wantErr bool
+	}{
+		{"without retry", nil, true},
+		{"retried until free", []OptionFunc{WithBindRetry(5, 20*time.Millisecond)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bound, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			freed := time.AfterFunc(30*time.Millisecond, func() { bound.Close() })
+			defer freed.Stop()
+			defer bound.Close()
+			c := New(tt.options...)
+			defer c.Close()
+			l, err := c.listen(bound.Addr().String())
+			if err == nil {
+				l.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listen() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !addrInUse(err) {
+				t.Errorf("listen() = %v, want the address in use", err)
+			}
+		})
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		want    string
+	}{
+		{"plain", nil, "too many connections"},
+		{"overload handler", []OptionFunc{WithOverloadHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("busy"))
+		})}, "busy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithMaxConnections(1))...)
+			if err := c.Register("/a", constant("a")); err != nil {
+				t.Fatal(err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go c.Serve(l)
+			defer c.Shutdown(context.Background())
+			url := "http://" + l.Addr().String() + "/a"
+
+			// The first client holds on to the only connection.
+			first := &http.Client{Transport: &http.Transport{}}
+			resp, err := first.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("first connection got %d", resp.StatusCode)
+			}
+
+			second := &http.Client{Transport: &http.Transport{}, Timeout: 5 * time.Second}
+			resp, err = second.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable || string(b) != tt.want {
+				t.Errorf("second connection got %d %q, want 503 %q", resp.StatusCode, b, tt.want)
+			}
+
+			// Once the first connection closes, a new one is served.
+			first.CloseIdleConnections()
+			time.Sleep(20 * time.Millisecond)
+			resp, err = second.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("after the first connection closed got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// start serves c on a local port until the test ends, and returns its URL.
+func start(t *testing.T, c *cache) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Serve(l)
+	t.Cleanup(func() { c.Shutdown(context.Background()) })
+	return "http://" + l.Addr().String()
+}
+
+func TestH2C(t *testing.T) {
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	tests := []struct {
+		name   string
+		client *http.Client
+		proto  int
+	}{
+		{"h2c client", h2cClient, 2},
+		{"HTTP/1.1 client", &http.Client{Transport: &http.Transport{}}, 1},
+	}
+	var calls int32
+	c := New(WithH2C(true), WithDefaultTTL(time.Hour))
+	if err := c.Register("/a", func([]string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte("a"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	url := start(t, c) + "/a"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				resp, err := tt.client.Get(url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || string(b) != "a" || resp.ProtoMajor != tt.proto {
+					t.Errorf("got %d %q over %s, want 200 \"a\" over HTTP/%d", resp.StatusCode, b, resp.Proto, tt.proto)
+				}
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handler called %d times, want the cached response served", n)
+	}
+}
+
+func TestWriteTimeoutDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		timeout time.Duration
+	}{
+		{"without a write timeout", nil, 0},
+		{"write timeout", []OptionFunc{WithWriteTimeout(300 * time.Millisecond)}, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deadlines := make(chan time.Time, 1)
+			c := New(tt.options...)
+			if err := c.RegisterContext("/a", func(ctx context.Context, _ []string) ([]byte, error) {
+				deadline, _ := ctx.Deadline()
+				deadlines <- deadline
+				return []byte("a"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			url := start(t, c) + "/a"
+			before := time.Now()
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			after := time.Now()
+			deadline := <-deadlines
+			if tt.timeout == 0 {
+				if !deadline.IsZero() {
+					t.Errorf("handler deadline = %v, want none", deadline)
+				}
+				return
+			}
+			if deadline.Before(before.Add(tt.timeout)) || deadline.After(after.Add(tt.timeout)) {
+				t.Errorf("handler deadline is %v after the request, want %v", deadline.Sub(before), tt.timeout)
+			}
+		})
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr error
+	}{
+		{"drained", 5 * time.Second, nil},
+		{"deadline", 50 * time.Millisecond, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, release := make(chan struct{}), make(chan struct{})
+			c := New(WithDefaultTTL(time.Hour))
+			if err := c.Register("/slow", func([]string) ([]byte, error) {
+				close(started)
+				<-release
+				return []byte("slow"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			// One request fills the entry and another waits for it.
+			var served sync.WaitGroup
+			var done atomic.Int32
+			for i := 0; i < 2; i++ {
+				served.Add(1)
+				go func() {
+					defer served.Done()
+					serve(t, c, http.MethodGet, "/slow")
+					done.Add(1)
+				}()
+			}
+			<-started
+			time.AfterFunc(200*time.Millisecond, func() { close(release) })
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			begun := time.Now()
+			err := c.Shutdown(ctx)
+			elapsed := time.Since(begun)
+			finished := done.Load()
+			served.Wait()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Shutdown() = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && finished != 2 {
+				t.Errorf("Shutdown returned after %v with %d of 2 requests done", elapsed, finished)
+			}
+			if tt.wantErr != nil && (finished != 0 || elapsed > 150*time.Millisecond) {
+				t.Errorf("Shutdown gave up after %v with %d requests done, want the deadline", elapsed, finished)
+			}
+		})
+	}
+}
+
+func TestKeepAlives(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		reused  bool
+	}{
+		{"enabled", true, true},
+		{"disabled", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithKeepAlivesEnabled(tt.enabled), WithIdleTimeout(time.Minute))
+			if err := c.Register("/x", constant("x")); err != nil {
+				t.Fatal(err)
+			}
+			url := start(t, c)
+			transport := &http.Transport{}
+			defer transport.CloseIdleConnections()
+			client := &http.Client{Transport: transport}
+			for i := 0; i < 2; i++ {
+				var reused bool
+				trace := &httptrace.ClientTrace{
+					GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+				}
+				req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, url+"/x", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.Close == tt.enabled {
+					t.Errorf("request %d: Connection: close = %v, want %v", i, resp.Close, !tt.enabled)
+				}
+				if i > 0 && reused != tt.reused {
+					t.Errorf("request %d: reused connection = %v, want %v", i, reused, tt.reused)
+				}
+			}
+		})
+	}
+	if err := WithIdleTimeout(0)(&cache{}); err == nil {
+		t.Error("WithIdleTimeout(0) succeeded")
+	}
+}
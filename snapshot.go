@@ -0,0 +1,86 @@
+package minicache
+
+import (
+	"encoding/gob"
+	"io"
+	"net/http"
+)
+
+type snapshotEntry struct {
+	Key   string
+	Entry StoredEntry
+}
+
+// Snapshot writes all populated entries to w, to be read back by Restore.
+func (c *cache) Snapshot(w io.Writer) error {
+	entries := c.snapshot()
+	out := make([]snapshotEntry, 0, len(entries))
+	for key, entry := range entries {
+		select {
+		case <-entry.ready:
+		default:
+			continue
+		}
+		if entry.err != nil {
+			continue
+		}
+		c.RLock()
+		tags := c.keyTags[key]
+		c.RUnlock()
+		entry.RLock()
+		out = append(out, snapshotEntry{Key: key, Entry: StoredEntry{
+			Body:     entry.value,
+			Header:   entry.header,
+			Status:   entry.status,
+			ETag:     entry.etag,
+			Tags:     tags,
+			Fetched:  entry.fetched,
+			Modified: entry.modified,
+			Expiry:   entry.expiry,
+		}})
+		entry.RUnlock()
+	}
+	return gob.NewEncoder(w).Encode(out)
+}
+
+// Restore adds the entries written by Snapshot to the cache, skipping those
+// that have expired since and those for keys already in the cache.
+func (c *cache) Restore(r io.Reader) error {
+	var in []snapshotEntry
+	if err := gob.NewDecoder(r).Decode(&in); err != nil {
+		return err
+	}
+	now := c.now()
+	for _, s := range in {
+		if s.Entry.IsStale(now) {
+			continue
+		}
+		entry := newCacheEntry()
+		entry.entryData = entryData{
+			value:    s.Entry.Body,
+			header:   s.Entry.Header,
+			status:   s.Entry.Status,
+			etag:     s.Entry.ETag,
+			fetched:  s.Entry.Fetched,
+			modified: s.Entry.Modified,
+			expiry:   s.Entry.Expiry,
+		}.withIdentity()
+		if entry.status == 0 {
+			entry.status = http.StatusOK
+		}
+		entry.partition = c.keyPartition(s.Key)
+		close(entry.ready)
+		c.Lock()
+		_, exists := c.cache[s.Key]
+		var evicted []eviction
+		if !exists {
+			evicted = c.insertLocked(s.Key, entry)
+		}
+		c.Unlock()
+		c.reportEvicted(evicted, EvictCapacity)
+		if !exists {
+			c.tag(s.Key, entry, s.Entry.Tags)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package minicache
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRestoreKeepsPartitions(t *testing.T) {
+	tests := []struct {
+		name      string
+		pattern   string
+		path      string
+		options   []RouteOptionFunc
+		partition func(c *cache) *partition
+	}{
+		{"default", "/d/:id", "/d/1", nil, func(c *cache) *partition { return c.defaultPartition }},
+		{"named", "/n/:id", "/n/1", []RouteOptionFunc{WithPartition("p")}, func(c *cache) *partition { return c.partitions["p"] }},
+		{"key segments", "/k/:id/:rest", "/k/1/2", []RouteOptionFunc{WithPartition("p"), WithKeySegments(1)}, func(c *cache) *partition { return c.partitions["p"] }},
+		{"cardinality", "/c/:id", "/c/1", []RouteOptionFunc{WithMaxDynamicCardinality(5)}, func(c *cache) *partition {
+			r, _ := c.lookup([]string{"c", "1"})
+			return r.cardinality
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newCache := func() *cache {
+				c := New(WithMaxEntries(10), WithPartitionLimit("p", 10, 0), WithDefaultTTL(time.Hour))
+				if err := c.Register(tt.pattern, constant("v"), tt.options...); err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+			src := newCache()
+			serve(t, src, http.MethodGet, tt.path)
+			var buf bytes.Buffer
+			if err := src.Snapshot(&buf); err != nil {
+				t.Fatal(err)
+			}
+			dst := newCache()
+			if err := dst.Restore(&buf); err != nil {
+				t.Fatal(err)
+			}
+			dst.RLock()
+			defer dst.RUnlock()
+			if len(dst.cache) != 1 {
+				t.Fatalf("restored %d entries, want 1", len(dst.cache))
+			}
+			want := tt.partition(dst)
+			for key, entry := range dst.cache {
+				if entry.partition != want {
+					t.Errorf("entry %s restored into the wrong partition", key)
+				}
+				if _, ok := want.sizes[key]; !ok {
+					t.Errorf("entry %s not counted against its partition", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package minicache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// SSEHandlerFunc streams server-sent events to w until it returns or ctx is
+// done, which happens when the client disconnects.
+type SSEHandlerFunc func(ctx context.Context, path []string, w *EventWriter) error
+
+// EventWriter writes server-sent events and flushes each one to the client.
+type EventWriter struct {
+	w http.ResponseWriter
+}
+
+// Send writes an event with the given type, which may be empty, and data.
+func (e *EventWriter) Send(event, data string) error {
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	if _, err := e.w.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// RegisterSSE registers a handler that streams text/event-stream responses.
+// They bypass the cache entirely.
+func (c *cache) RegisterSSE(path string, handler SSEHandlerFunc, options ...RouteOptionFunc) error {
+	c.routesMu.Lock()
+	defer c.routesMu.Unlock()
+	return c.registerLocked(path, options, func(r, _ *route) {
+		r.variants = nil
+		r.handler = func(context.Context, []string) (*Response, error) {
+			return nil, errors.New("event streams are not cached")
+		}
+		r.sse = handler
+	})
+}
+
+func (c *cache) serveSSE(w http.ResponseWriter, r *http.Request, route *route, path []string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	err := route.sse(r.Context(), path, &EventWriter{w: w})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		c.logger(r.Context()).Error(err, "event stream failed", "path", route.pattern)
+	}
+}
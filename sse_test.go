@@ -0,0 +1,87 @@
+package minicache
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterSSE(t *testing.T) {
+	c := New(WithDefaultTTL(time.Hour))
+	stopped := make(chan struct{})
+	if err := c.RegisterSSE("/events/:topic", func(ctx context.Context, p []string, w *EventWriter) error {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			if err := w.Send(p[1], "line "+strconv.Itoa(i)+"\nmore"); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register("/cached", constant("c")); err != nil {
+		t.Fatal(err)
+	}
+	url := start(t, c)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/events/news", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+	tests := []struct {
+		event string
+		data  []string
+	}{
+		{"news", []string{"line 0", "more"}},
+		{"news", []string{"line 1", "more"}},
+		{"news", []string{"line 2", "more"}},
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for i, want := range tests {
+		var event string
+		var data []string
+		for scanner.Scan() && scanner.Text() != "" {
+			line := scanner.Text()
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				event = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				data = append(data, v)
+			}
+		}
+		if event != want.event || strings.Join(data, "\n") != strings.Join(want.data, "\n") {
+			t.Errorf("event %d = %q %q, want %q %q", i, event, data, want.event, want.data)
+		}
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler kept streaming after the client disconnected")
+	}
+	if got := body(t, serve(t, c, http.MethodGet, "/cached")); got != "c" {
+		t.Errorf("cached route = %q, want c", got)
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if _, ok := c.cache["/events/news"]; ok {
+		t.Error("event stream was cached")
+	}
+}
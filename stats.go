@@ -0,0 +1,62 @@
+package minicache
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+)
+
+type Stats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	WriteErrors uint64 `json:"writeErrors"`
+	Evictions   uint64 `json:"evictions"`
+	Entries     int    `json:"entries"`
+}
+
+type counters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	writeErrors atomic.Uint64
+	evictions   atomic.Uint64
+}
+
+func (c *cache) Stats() Stats {
+	c.RLock()
+	entries := len(c.cache)
+	c.RUnlock()
+	return Stats{
+		Hits:        c.counters.hits.Load(),
+		Misses:      c.counters.misses.Load(),
+		WriteErrors: c.counters.writeErrors.Load(),
+		Evictions:   c.counters.evictions.Load(),
+		Entries:     entries,
+	}
+}
+
+// WithExpvar publishes Stats as the expvar variable name once New has set
+// up the cache. Names can only be published once per process.
+func WithExpvar(name string) OptionFunc {
+	return func(c *cache) error {
+		if name == "" {
+			return errors.New("expvar name must not be empty")
+		}
+		if expvar.Get(name) != nil {
+			return fmt.Errorf("expvar %q is already published", name)
+		}
+		c.expvarName = name
+		return nil
+	}
+}
+
+// publishExpvar publishes the variable named by WithExpvar, if any.
+func (c *cache) publishExpvar() {
+	if c.expvarName == "" {
+		return
+	}
+	if expvar.Get(c.expvarName) != nil {
+		panic(fmt.Errorf("expvar %q is already published", c.expvarName))
+	}
+	expvar.Publish(c.expvarName, expvar.Func(func() any { return c.Stats() }))
+}
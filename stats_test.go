@@ -0,0 +1,56 @@
+package minicache
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// expvarRuns keeps expvar names unique across repeated test runs, as
+// published variables cannot be removed.
+var expvarRuns int32
+
+func TestWithExpvar(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		publish bool
+	}{
+		{"published", nil, true},
+		{"failed New", []OptionFunc{WithClock(nil)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("minicache_test_stats_%d", atomic.AddInt32(&expvarRuns, 1))
+			var c *cache
+			func() {
+				defer func() { recover() }()
+				c = New(append(tt.options, WithExpvar(name))...)
+			}()
+			v := expvar.Get(name)
+			if !tt.publish {
+				if v != nil {
+					t.Error("a cache that New failed to set up was published")
+				}
+				return
+			}
+			if c == nil || v == nil {
+				t.Fatal("expvar not published")
+			}
+			if err := c.Register("/a", constant("a")); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/a")
+			var stats Stats
+			if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+				t.Fatal(err)
+			}
+			if stats.Misses != 1 || stats.Entries != 1 {
+				t.Errorf("stats = %+v", stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package minicache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Store is a secondary cache, such as a disk or Redis, that sits behind the
+// in-memory one. It is consulted on a miss in memory and written through
+// whenever an entry is populated or renewed.
+type Store interface {
+	// Get returns the entry stored under key, or nil if there is none.
+	Get(ctx context.Context, key string) (*StoredEntry, error)
+	Set(ctx context.Context, key string, e *StoredEntry) error
+}
+
+type StoredEntry struct {
+	Body     []byte
+	Header   http.Header
+	Status   int
+	ETag     string
+	Tags     []string
+	Fetched  time.Time
+	Modified time.Time
+	Expiry   time.Time
+}
+
+func (e *StoredEntry) IsStale(now time.Time) bool {
+	return e.Expiry.Before(now)
+}
+
+func WithStore(s Store) OptionFunc {
+	return func(c *cache) error {
+		c.store = s
+		return nil
+	}
+}
+
+// WithServeStaleFromStore serves a stale entry found in the store on a miss
+// in memory right away, and refreshes it in the background, instead of
+// waiting for the handler.
+func WithServeStaleFromStore() OptionFunc {
+	return func(c *cache) error {
+		c.serveStaleFromStore = true
+		return nil
+	}
+}
+
+// load populates a new entry from the store. It reports false, leaving the
+// entry for the handler to fill, if there is nothing usable in the store.
+func (c *cache) load(ctx context.Context, key string, entry *cacheEntry) bool {
+	if c.store == nil {
+		return false
+	}
+	l := c.logger(ctx)
+	stored, err := c.store.Get(ctx, key)
+	if err != nil {
+		l.Error(err, "failed to read from store", "key", key)
+		return false
+	}
+	if stored == nil {
+		return false
+	}
+	if stored.IsStale(c.now()) && !c.serveStaleFromStore {
+		l.V(3).Info("stored entry is stale, populating from handler", "key", key)
+		return false
+	}
+	entry.Lock()
+	entry.entryData = entryData{
+		value:    stored.Body,
+		header:   stored.Header.Clone(),
+		status:   stored.Status,
+		etag:     stored.ETag,
+		fetched:  stored.Fetched,
+		modified: stored.Modified,
+		expiry:   stored.Expiry,
+	}.withIdentity()
+	if entry.status == 0 {
+		entry.status = http.StatusOK
+	}
+	entry.Unlock()
+	close(entry.ready)
+	c.resized(key, entry)
+	c.tag(key, entry, stored.Tags)
+	l.Info("populated cache from store", "key", key, "expires-at", stored.Expiry.Format(time.RFC3339))
+	return true
+}
+
+func (c *cache) save(ctx context.Context, key string, data entryData, tags []string) {
+	if c.store == nil {
+		return
+	}
+	err := c.store.Set(ctx, key, &StoredEntry{
+		Body:     data.value,
+		Header:   data.header,
+		Status:   data.status,
+		ETag:     data.etag,
+		Tags:     tags,
+		Fetched:  data.fetched,
+		Modified: data.modified,
+		Expiry:   data.expiry,
+	})
+	if err != nil {
+		c.logger(ctx).Error(err, "failed to write to store", "key", key)
+	}
+}
@@ -0,0 +1,60 @@
+package minicache
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeStaleFromStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   []OptionFunc
+		block     bool
+		wantFirst string
+	}{
+		{"served while refreshing", []OptionFunc{WithServeStaleFromStore()}, true, "stale"},
+		{"without the option", nil, false, "fresh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			store := &memStore{entries: map[string]*StoredEntry{
+				"/a": {Body: []byte("stale"), Status: http.StatusOK, Fetched: now.Add(-2 * time.Hour), Expiry: now.Add(-time.Hour)},
+			}}
+			release := make(chan struct{})
+			if !tt.block {
+				close(release)
+			}
+			var calls int32
+			c := New(append(tt.options, WithStore(store), WithDefaultTTL(time.Hour))...)
+			if err := c.Register("/a", func([]string) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte("fresh"), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, "/a")
+			if got := body(t, w); w.Code != http.StatusOK || got != tt.wantFirst {
+				t.Errorf("first GET = %d %q, want %q", w.Code, got, tt.wantFirst)
+			}
+			if tt.block {
+				close(release)
+			}
+			settled(t, c, "/a")
+			if got := body(t, serve(t, c, http.MethodGet, "/a")); got != "fresh" {
+				t.Errorf("GET once refreshed = %q, want fresh", got)
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("handler called %d times, want 1", n)
+			}
+			stored, _ := store.Get(context.Background(), "/a")
+			if string(stored.Body) != "fresh" || stored.IsStale(time.Now()) {
+				t.Errorf("store holds %q until %v, want the refreshed value", stored.Body, stored.Expiry)
+			}
+		})
+	}
+}
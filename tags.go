@@ -0,0 +1,77 @@
+package minicache
+
+import (
+	"errors"
+	"strings"
+)
+
+// WithSurrogateKeyHeader also tags entries with the space-separated keys that
+// handlers return in the named response header, such as Surrogate-Key.
+func WithSurrogateKeyHeader(name string) OptionFunc {
+	return func(c *cache) error {
+		if name == "" {
+			return errors.New("surrogate key header name must not be empty")
+		}
+		c.surrogateKeyHeader = name
+		return nil
+	}
+}
+
+func (c *cache) responseTags(resp *Response) []string {
+	if c.surrogateKeyHeader == "" {
+		return resp.Tags
+	}
+	tags := append([]string(nil), resp.Tags...)
+	for _, v := range resp.Header.Values(c.surrogateKeyHeader) {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	return tags
+}
+
+// tag replaces the tags indexed for key, provided key still maps to entry.
+func (c *cache) tag(key string, entry *cacheEntry, tags []string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.cache[key] != entry {
+		return
+	}
+	c.untagLocked(key)
+	if len(tags) == 0 {
+		return
+	}
+	c.keyTags[key] = append([]string(nil), tags...)
+	for _, t := range tags {
+		if c.tags[t] == nil {
+			c.tags[t] = make(map[string]struct{})
+		}
+		c.tags[t][key] = struct{}{}
+	}
+}
+
+func (c *cache) untagLocked(key string) {
+	for _, t := range c.keyTags[key] {
+		delete(c.tags[t], key)
+		if len(c.tags[t]) == 0 {
+			delete(c.tags, t)
+		}
+	}
+	delete(c.keyTags, key)
+}
+
+func (c *cache) PurgeTag(tag string) {
+	c.Lock()
+	purged := make(map[string]*cacheEntry, len(c.tags[tag]))
+	for key := range c.tags[tag] {
+		if entry, ok := c.cache[key]; ok {
+			purged[key] = entry
+			c.forgetLocked(key, entry)
+		}
+		delete(c.cache, key)
+		c.untagLocked(key)
+		c.unvaryLocked(key)
+	}
+	c.Unlock()
+	for key, entry := range purged {
+		c.evicted(key, entry, EvictPurged)
+	}
+}
@@ -0,0 +1,87 @@
+package minicache
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSurrogateKeyHeader(t *testing.T) {
+	t.Run("empty name", func(t *testing.T) {
+		if err := WithSurrogateKeyHeader("")(&cache{}); err == nil {
+			t.Error("WithSurrogateKeyHeader(\"\") succeeded")
+		}
+	})
+	c := New(WithSurrogateKeyHeader("Surrogate-Key"), WithDefaultTTL(time.Hour))
+	if err := c.RegisterResponse("/a", func(context.Context, []string) (*Response, error) {
+		return &Response{Body: []byte("a"), Header: http.Header{"Surrogate-Key": {"x y"}}, Tags: []string{"z"}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	serve(t, c, http.MethodGet, "/a")
+	for _, tag := range []string{"x", "y", "z"} {
+		c.RLock()
+		_, tagged := c.tags[tag]["/a"]
+		c.RUnlock()
+		if !tagged {
+			t.Errorf("entry not tagged %s", tag)
+		}
+	}
+	c.PurgeTag("y")
+	c.RLock()
+	defer c.RUnlock()
+	if _, ok := c.cache["/a"]; ok {
+		t.Error("entry survived purging one of its surrogate keys")
+	}
+}
+
+func TestPurgeTag(t *testing.T) {
+	tagged := map[string][]string{
+		"/products/1": {"product", "sale"},
+		"/products/2": {"product"},
+		"/home":       nil,
+	}
+	tests := []struct {
+		tag    string
+		purged []string
+		kept   []string
+	}{
+		{"product", []string{"/products/1", "/products/2"}, []string{"/home"}},
+		{"sale", []string{"/products/1"}, []string{"/products/2", "/home"}},
+		{"unknown", nil, []string{"/products/1", "/products/2", "/home"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			c := New(WithDefaultTTL(time.Hour))
+			for path, tags := range tagged {
+				tags := tags
+				if err := c.RegisterResponse(path, func(context.Context, []string) (*Response, error) {
+					return &Response{Body: []byte("v"), Tags: tags}, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				serve(t, c, http.MethodGet, path)
+			}
+			c.PurgeTag(tt.tag)
+			c.RLock()
+			defer c.RUnlock()
+			for _, path := range tt.purged {
+				if _, ok := c.cache[path]; ok {
+					t.Errorf("%s survived PurgeTag(%q)", path, tt.tag)
+				}
+				if _, ok := c.keyTags[path]; ok {
+					t.Errorf("%s still indexed after PurgeTag(%q)", path, tt.tag)
+				}
+			}
+			for _, path := range tt.kept {
+				if _, ok := c.cache[path]; !ok {
+					t.Errorf("%s purged by PurgeTag(%q)", path, tt.tag)
+				}
+			}
+			if _, ok := c.tags[tt.tag]; ok {
+				t.Errorf("tag %q still indexed", tt.tag)
+			}
+		})
+	}
+}
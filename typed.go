@@ -0,0 +1,52 @@
+package minicache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// SerializerFunc encodes the result of a typed handler and reports its
+// content type.
+type SerializerFunc func(v any) ([]byte, string, error)
+
+func WithSerializer(s SerializerFunc) OptionFunc {
+	return func(c *cache) error {
+		if s == nil {
+			return errors.New("serializer must not be nil")
+		}
+		c.serializer = s
+		return nil
+	}
+}
+
+func jsonSerializer(v any) ([]byte, string, error) {
+	b, err := json.Marshal(v)
+	return b, "application/json", err
+}
+
+// RegisterTyped registers a handler whose results are encoded by the
+// serializer set with WithSerializer, JSON by default. A nil result is
+// treated as not found.
+func (c *cache) RegisterTyped(path string, handler func(path []string) (any, error), options ...RouteOptionFunc) error {
+	return c.RegisterResponse(path, func(_ context.Context, p []string) (*Response, error) {
+		v, err := handler(p)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		serialize := c.serializer
+		if serialize == nil {
+			serialize = jsonSerializer
+		}
+		b, contentType, err := serialize(v)
+		if err != nil {
+			return nil, err
+		}
+		resp := &Response{Body: b}
+		if contentType != "" {
+			resp.Header = http.Header{"Content-Type": {contentType}}
+		}
+		return resp, nil
+	}, options...)
+}
@@ -0,0 +1,64 @@
+package minicache
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type user struct {
+	XMLName xml.Name `json:"-" xml:"user"`
+	Name    string   `json:"name" xml:"name"`
+}
+
+func TestRegisterTyped(t *testing.T) {
+	errUnsupported := errors.New("unsupported value")
+	tests := []struct {
+		name        string
+		options     []OptionFunc
+		path        string
+		code        int
+		body        string
+		contentType string
+	}{
+		{"json by default", nil, "/users/alice", http.StatusOK, `{"name":"alice"}`, "application/json"},
+		{"xml", []OptionFunc{WithSerializer(func(v any) ([]byte, string, error) {
+			b, err := xml.Marshal(v)
+			return b, "application/xml", err
+		})}, "/users/alice", http.StatusOK, "<user><name>alice</name></user>", "application/xml"},
+		{"serializer without a content type", []OptionFunc{WithDefaultContentType("text/plain"), WithSerializer(func(v any) ([]byte, string, error) {
+			return []byte(v.(user).Name), "", nil
+		})}, "/users/alice", http.StatusOK, "alice", "text/plain"},
+		{"serializer error", []OptionFunc{WithSerializer(func(any) ([]byte, string, error) {
+			return nil, "", errUnsupported
+		})}, "/users/alice", http.StatusInternalServerError, errUnsupported.Error(), "text/plain"},
+		{"nil result", nil, "/users/nobody", http.StatusNotFound, ErrNotFound.Error(), "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			if err := c.RegisterTyped("/users/:name", func(p []string) (any, error) {
+				if p[1] == "nobody" {
+					return nil, nil
+				}
+				return user{Name: p[1]}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(t, c, http.MethodGet, tt.path)
+			if got := body(t, w); w.Code != tt.code || got != tt.body {
+				t.Errorf("GET = %d %q, want %d %q", w.Code, got, tt.code, tt.body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+		})
+	}
+	t.Run("nil serializer", func(t *testing.T) {
+		if err := WithSerializer(nil)(&cache{}); err == nil {
+			t.Error("WithSerializer(nil) succeeded")
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package minicache
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Validate checks the route tree for static segments that a constrained
+// parameter at the same position explicitly matches too. Such segments are
+// always routed statically, which is rarely what the constraint was meant
+// for. All problems found are joined into one error.
+func (c *cache) Validate() error {
+	var errs []error
+	var walk func(r *route, prefix string)
+	walk = func(r *route, prefix string) {
+		segments := make([]string, 0, len(r.staticChildren))
+		for s := range r.staticChildren {
+			segments = append(segments, s)
+		}
+		sort.Strings(segments)
+		for _, s := range segments {
+			for _, d := range r.dynamicChildren {
+				if d.constraint != nil && d.constraint.MatchString(s) {
+					errs = append(errs, fmt.Errorf("%w: %s/%s is also matched by %s/%s", ErrConflictingRoute, prefix, s, prefix, d.segment))
+				}
+			}
+		}
+		for _, s := range segments {
+			walk(r.staticChildren[s], prefix+"/"+s)
+		}
+		for _, d := range r.dynamicChildren {
+			walk(d, prefix+"/"+d.segment)
+		}
+	}
+	c.routesMu.RLock()
+	walk(c.root, "")
+	c.routesMu.RUnlock()
+	return errors.Join(errs...)
+}
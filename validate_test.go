@@ -0,0 +1,62 @@
+package minicache
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		patterns  []string
+		remove    []string
+		conflicts []string
+	}{
+		{"empty", nil, nil, nil},
+		{"static and unconstrained", []string{"/users/me", "/users/:id", "/files/*"}, nil, nil},
+		{"constraint not matching", []string{"/users/me", `/users/:id(\d+)`}, nil, nil},
+		{"constraint matching", []string{"/users/me", `/users/:id(\w+)`}, nil, []string{`/users/me is also matched by /users/:id(\w+)`}},
+		{"several", []string{"/a/x", "/a/y", "/a/:id([a-z])", "/b/1", `/b/:n(\d)`}, nil, []string{
+			"/a/x is also matched by /a/:id([a-z])",
+			"/a/y is also matched by /a/:id([a-z])",
+			`/b/1 is also matched by /b/:n(\d)`,
+		}},
+		{"deep", []string{"/v1/users/me/posts", `/v1/users/:id(\w+)/posts`}, nil, []string{`/v1/users/me is also matched by /v1/users/:id(\w+)`}},
+		{"unregistered", []string{"/users/me", `/users/:id(\w+)`, "/users/me/posts"}, []string{"/users/me", "/users/me/posts"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			for _, p := range tt.patterns {
+				if err := c.Register(p, constant("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, p := range tt.remove {
+				if err := c.Unregister(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := c.Validate()
+			if len(tt.conflicts) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrConflictingRoute) {
+				t.Fatalf("Validate() = %v, want ErrConflictingRoute", err)
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.conflicts) {
+				t.Fatalf("Validate() = %v, want %d problems", err, len(tt.conflicts))
+			}
+			for i, want := range tt.conflicts {
+				if !strings.HasSuffix(lines[i], want) {
+					t.Errorf("problem %d = %q, want %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
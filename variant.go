@@ -0,0 +1,86 @@
+package minicache
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+)
+
+type variant struct {
+	handler ResponseHandlerFunc
+	weight  int
+}
+
+// RegisterVariant adds handler as one of several weighted variants served
+// for path. Each request is assigned a variant, and variants are cached
+// separately. Registering a plain handler for path drops its variants, and
+// the options of the latest variant apply to all of them.
+func (c *cache) RegisterVariant(path string, handler HandlerFunc, weight int, options ...RouteOptionFunc) error {
+	if weight < 1 {
+		return errors.New("variant weight must be positive")
+	}
+	c.routesMu.Lock()
+	defer c.routesMu.Unlock()
+	return c.registerLocked(path, options, func(r, existing *route) {
+		if existing != nil {
+			r.variants = existing.variants
+		}
+		r.variants = append(r.variants[:len(r.variants):len(r.variants)], variant{
+			handler: func(_ context.Context, p []string) (*Response, error) {
+				b, err := handler(p)
+				if b == nil {
+					return nil, err
+				}
+				return &Response{Body: b}, err
+			},
+			weight: weight,
+		})
+		variants := r.variants
+		r.sse = nil
+		r.handler = func(ctx context.Context, p []string) (*Response, error) {
+			i, _ := ctx.Value(variantKey).(int)
+			return variants[i].handler(ctx, p)
+		}
+	})
+}
+
+// WithVariantClientID makes variant assignment sticky: requests for which
+// id returns the same non-empty value always get the same variant. Without
+// it, or for an empty id, variants are picked at random by weight.
+func WithVariantClientID(id func(r *http.Request) string) OptionFunc {
+	return func(c *cache) error {
+		c.variantClientID = id
+		return nil
+	}
+}
+
+func (c *cache) pickVariant(r *http.Request, variants []variant) int {
+	total := 0
+	for _, v := range variants {
+		total += v.weight
+	}
+	var n int
+	if id := c.clientID(r); id != "" {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+	for i, v := range variants {
+		if n < v.weight {
+			return i
+		}
+		n -= v.weight
+	}
+	return len(variants) - 1
+}
+
+func (c *cache) clientID(r *http.Request) string {
+	if c.variantClientID == nil {
+		return ""
+	}
+	return c.variantClientID(r)
+}
@@ -0,0 +1,84 @@
+package minicache
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegisterVariant(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+	}{
+		{"even", map[string]int{"a": 1, "b": 1}},
+		{"one in four", map[string]int{"a": 1, "b": 3}},
+		{"three ways", map[string]int{"a": 2, "b": 1, "c": 1}},
+	}
+	const requests = 4000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := New(WithDefaultTTL(time.Hour))
+			total := 0
+			for name, weight := range tt.weights {
+				name := name
+				total += weight
+				if err := c.RegisterVariant("/exp", func([]string) ([]byte, error) {
+					atomic.AddInt32(&calls, 1)
+					return []byte(name), nil
+				}, weight); err != nil {
+					t.Fatal(err)
+				}
+			}
+			served := make(map[string]int)
+			for i := 0; i < requests; i++ {
+				served[body(t, serve(t, c, http.MethodGet, "/exp"))]++
+			}
+			for name, weight := range tt.weights {
+				want := float64(weight) / float64(total)
+				if got := float64(served[name]) / requests; math.Abs(got-want) > 0.05 {
+					t.Errorf("variant %s served %.3f of requests, want %.3f", name, got, want)
+				}
+			}
+			if n := int(atomic.LoadInt32(&calls)); n != len(tt.weights) {
+				t.Errorf("handlers called %d times, want once per variant", n)
+			}
+			c.RLock()
+			defer c.RUnlock()
+			for i := 0; i < len(tt.weights); i++ {
+				if _, ok := c.cache["/exp?variant="+strconv.Itoa(i)]; !ok {
+					t.Errorf("no entry for variant %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestVariantClientID(t *testing.T) {
+	c := New(WithDefaultTTL(time.Hour), WithVariantClientID(func(r *http.Request) string {
+		return r.Header.Get("X-Client")
+	}))
+	for _, name := range []string{"a", "b", "c"} {
+		if err := c.RegisterVariant("/exp", constant(name), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		id := "client-" + strconv.Itoa(i)
+		first := body(t, serve(t, c, http.MethodGet, "/exp", "X-Client", id))
+		seen[first] = true
+		for j := 0; j < 5; j++ {
+			if got := body(t, serve(t, c, http.MethodGet, "/exp", "X-Client", id)); got != first {
+				t.Fatalf("%s got variant %s after %s", id, got, first)
+			}
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("clients were assigned %d variants, want all 3", len(seen))
+	}
+}
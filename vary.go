@@ -0,0 +1,103 @@
+package minicache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// variation records how the responses for a key vary: by the request
+// headers names, and by the variant key the handler reported last.
+type variation struct {
+	names      []string
+	variantKey string
+	// keys holds the keys of the cached entries filed under the variation,
+	// which is dropped along with the last of them.
+	keys map[string]struct{}
+}
+
+// key returns the key of the entry for req filed under base.
+func (v *variation) key(base string, req *http.Request) string {
+	key := varyKey(base, req, v.names)
+	if v.variantKey != "" {
+		key = withKeyParam(key, "variant-key", v.variantKey)
+	}
+	return key
+}
+
+// vary files entry, filled under key, by what resp reports it varies by,
+// and returns its new key. The request headers named by the first fill to
+// report them are kept, while the variant key is the latest reported, so
+// that a response reporting another one moves the entry there.
+func (c *cache) vary(req *http.Request, key string, entry *cacheEntry, resp *Response) string {
+	base, varied := req.Context().Value(variedKey).(string)
+	if !varied {
+		base = key
+	}
+	c.Lock()
+	v := c.varies[base]
+	if v == nil {
+		v = &variation{keys: make(map[string]struct{})}
+		for _, name := range resp.Vary {
+			v.names = append(v.names, http.CanonicalHeaderKey(name))
+		}
+	}
+	v.variantKey = resp.VariantKey
+	target := v.key(base, req)
+	var evicted []eviction
+	if target != key && c.cache[key] == entry {
+		delete(c.cache, key)
+		c.untagLocked(key)
+		c.forgetLocked(key, entry)
+		c.unvaryLocked(key)
+		if _, ok := c.cache[target]; !ok {
+			evicted = c.insertLocked(target, entry)
+		}
+	}
+	if c.cache[target] == entry {
+		if c.varies == nil {
+			c.varies = make(map[string]*variation)
+			c.variedFrom = make(map[string]string)
+		}
+		c.varies[base] = v
+		c.variedFrom[target] = base
+		v.keys[target] = struct{}{}
+	}
+	c.Unlock()
+	c.reportEvicted(evicted, EvictCapacity)
+	return target
+}
+
+// unvaryLocked forgets that the entry for key was filed under a variation,
+// and drops the variation along with its last entry. The caller holds the
+// cache lock.
+func (c *cache) unvaryLocked(key string) {
+	base, ok := c.variedFrom[key]
+	if !ok {
+		return
+	}
+	delete(c.variedFrom, key)
+	v := c.varies[base]
+	delete(v.keys, key)
+	if len(v.keys) == 0 {
+		delete(c.varies, base)
+	}
+}
+
+// variation returns how responses for key were reported to vary, if they
+// were.
+func (c *cache) variation(key string) (*variation, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	v, ok := c.varies[key]
+	if !ok {
+		return nil, false
+	}
+	return &variation{names: v.names, variantKey: v.variantKey}, true
+}
+
+func varyKey(key string, r *http.Request, names []string) string {
+	for _, name := range names {
+		key = withKeyParam(key, "vary-"+strings.ToLower(name), r.Header.Get(name))
+	}
+	return key
+}
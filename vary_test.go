@@ -0,0 +1,117 @@
+package minicache
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVariantKey(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	flag, calls := "a", 0
+	c := New(WithDefaultTTL(time.Minute), WithClock(clock), WithoutBackgroundRenewal())
+	if err := c.RegisterResponse("/p/:id", func(_ context.Context, p []string) (*Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return &Response{Body: []byte(p[1] + flag), VariantKey: flag}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	keys := func() []string {
+		c.RLock()
+		defer c.RUnlock()
+		var keys []string
+		for k := range c.cache {
+			keys = append(keys, k)
+		}
+		return keys
+	}
+	steps := []struct {
+		name     string
+		path     string
+		flag     string
+		advance  time.Duration
+		want     string
+		wantCall bool
+		wantKey  string
+	}{
+		{"first fill is re-keyed", "/p/1", "a", 0, "1a", true, "/p/1?variant-key=a"},
+		{"later requests hit", "/p/1", "a", 0, "1a", false, "/p/1?variant-key=a"},
+		{"other paths are distinct", "/p/2", "a", 0, "2a", true, "/p/2?variant-key=a"},
+		{"renewal moves the entry", "/p/1", "b", 2 * time.Minute, "1b", true, "/p/1?variant-key=b"},
+		{"moved entry hits", "/p/1", "b", 0, "1b", false, "/p/1?variant-key=b"},
+	}
+	for _, s := range steps {
+		mu.Lock()
+		flag = s.flag
+		now = now.Add(s.advance)
+		before := calls
+		mu.Unlock()
+		if got := body(t, serve(t, c, http.MethodGet, s.path)); got != s.want {
+			t.Errorf("%s: GET %s = %q, want %q", s.name, s.path, got, s.want)
+		}
+		mu.Lock()
+		called := calls > before
+		mu.Unlock()
+		if called != s.wantCall {
+			t.Errorf("%s: handler called = %v, want %v", s.name, called, s.wantCall)
+		}
+		c.RLock()
+		_, ok := c.cache[s.wantKey]
+		c.RUnlock()
+		if !ok {
+			t.Errorf("%s: no entry for %s in %v", s.name, s.wantKey, keys())
+		}
+	}
+	if _, ok := c.cache["/p/1?variant-key=a"]; ok {
+		t.Error("the entry of the previous variant key is still cached")
+	}
+}
+
+func TestVariationsArePruned(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []OptionFunc
+		remove  func(c *cache)
+	}{
+		{"purge", nil, func(c *cache) { c.Purge("/v") }},
+		{"clear", nil, func(c *cache) { c.Clear() }},
+		{"purge tag", nil, func(c *cache) { c.PurgeTag("t") }},
+		{"eviction", []OptionFunc{WithMaxEntries(1)}, func(c *cache) {
+			serve(t, c, http.MethodGet, "/other")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithDefaultTTL(time.Minute))...)
+			if err := c.RegisterResponse("/v", func(context.Context, []string) (*Response, error) {
+				return &Response{Body: []byte("v"), Vary: []string{"X-Lang"}, VariantKey: "k", Tags: []string{"t"}}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Register("/other", constant("o")); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/v", "X-Lang", "en")
+			serve(t, c, http.MethodGet, "/v", "X-Lang", "de")
+			if _, ok := c.variation("/v"); !ok {
+				t.Fatal("no variation recorded")
+			}
+			tt.remove(c)
+			c.RLock()
+			defer c.RUnlock()
+			if len(c.varies) != 0 || len(c.variedFrom) != 0 {
+				t.Errorf("variations left after removing their entries: %v %v", c.varies, c.variedFrom)
+			}
+		})
+	}
+}
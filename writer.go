@@ -0,0 +1,131 @@
+package minicache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// responseWriter records the status and size of a response along with the
+// first write error. Once a write has failed, further writes are dropped so
+// a broken connection is not written to again.
+type responseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	err     error
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	w.err = err
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.err == nil {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// copyFlushing copies src to w, flushing after every chunk if w supports it
+// so that the client sees a streamed body as it is produced.
+func copyFlushing(w http.ResponseWriter, src io.Reader) error {
+	f, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// throttledWriter paces writes so that the body is sent at no more than rate
+// bytes per second, measured from the first write.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	rate    int
+	start   time.Time
+	written int64
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	if w.start.IsZero() {
+		w.start = time.Now()
+	}
+	chunk := w.rate / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	total := 0
+	for len(b) > 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		written, err := w.ResponseWriter.Write(b[:n])
+		total += written
+		w.written += int64(written)
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+		due := w.start.Add(time.Duration(w.written) * time.Second / time.Duration(w.rate))
+		if wait := time.Until(due); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-w.ctx.Done():
+				t.Stop()
+				return total, w.ctx.Err()
+			}
+		}
+	}
+	return total, nil
+}
+
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
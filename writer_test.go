@@ -0,0 +1,126 @@
+package minicache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errClientGone = errors.New("client gone")
+
+// failingWriter accepts up to limit bytes of body and then fails.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if left := w.limit - w.Body.Len(); len(b) > left {
+		n, _ := w.ResponseRecorder.Write(b[:left])
+		return n, errClientGone
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestWriteErrors(t *testing.T) {
+	big := strings.Repeat("x", 100<<10)
+	tests := []struct {
+		name      string
+		stream    bool
+		limit     int
+		wantError bool
+	}{
+		{"fits", false, len(big), false},
+		{"fails partway", false, 1000, true},
+		{"stream fits", true, len(big), false},
+		{"stream fails partway", true, 1000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			c := New(WithCombinedLog(&log), WithDefaultTTL(time.Hour))
+			if err := c.RegisterResponse("/a", func(context.Context, []string) (*Response, error) {
+				if tt.stream {
+					return &Response{Stream: io.NopCloser(strings.NewReader(big))}, nil
+				}
+				return &Response{Body: []byte(big)}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			w := &failingWriter{ResponseRecorder: httptest.NewRecorder(), limit: tt.limit}
+			aborted := func() (aborted bool) {
+				defer func() {
+					if v := recover(); v != nil {
+						if v != http.ErrAbortHandler {
+							panic(v)
+						}
+						aborted = true
+					}
+				}()
+				c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+				return false
+			}()
+			if aborted != tt.wantError {
+				t.Errorf("aborted = %v, want %v", aborted, tt.wantError)
+			}
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %d, want the 200 written before the failure", w.Code)
+			}
+			if want := tt.limit; w.Body.Len() != want || w.Body.String() != big[:want] {
+				t.Errorf("client got %d bytes, want the first %d", w.Body.Len(), want)
+			}
+			var wantErrors uint64
+			if tt.wantError {
+				wantErrors = 1
+			}
+			if got := c.Stats().WriteErrors; got != wantErrors {
+				t.Errorf("write errors = %d, want %d", got, wantErrors)
+			}
+			line := strings.TrimSuffix(log.String(), "\n")
+			if logged := strings.HasSuffix(line, ` "client gone"`); logged != tt.wantError {
+				t.Errorf("access log line %q, want the write error logged: %v", line, tt.wantError)
+			}
+			// The entry is still populated for the next client.
+			if got := body(t, serve(t, c, http.MethodGet, "/a")); got != big {
+				t.Errorf("next GET got %d bytes, want %d", len(got), len(big))
+			}
+		})
+	}
+}
+
+func TestMaxStreamRate(t *testing.T) {
+	payload := strings.Repeat("x", 5000)
+	tests := []struct {
+		name     string
+		options  []OptionFunc
+		min, max time.Duration
+	}{
+		{"unthrottled", nil, 0, 200 * time.Millisecond},
+		{"20 kB/s", []OptionFunc{WithMaxStreamRate(20000)}, 200 * time.Millisecond, time.Second},
+		{"10 kB/s", []OptionFunc{WithMaxStreamRate(10000)}, 450 * time.Millisecond, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(append(tt.options, WithDefaultTTL(time.Hour))...)
+			if err := c.Register("/large", constant(payload)); err != nil {
+				t.Fatal(err)
+			}
+			serve(t, c, http.MethodGet, "/large")
+			start := time.Now()
+			w := serve(t, c, http.MethodGet, "/large")
+			elapsed := time.Since(start)
+			if w.Body.String() != payload {
+				t.Fatalf("got %d bytes, want %d", w.Body.Len(), len(payload))
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("served in %v, want between %v and %v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}